@@ -0,0 +1,234 @@
+package pbft
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+)
+
+// authenticatedMessage is a message on the normal-case path that may be
+// authenticated either with a signature or with a vector of MACs, one per
+// replica.
+type authenticatedMessage interface {
+	signedMessage
+	authenticator() [][]byte
+	setAuthenticator(macs [][]byte)
+}
+
+type authenticator interface {
+	authenticate(msg authenticatedMessage)
+	verifyReplica(replicaId int, msg authenticatedMessage) bool
+	verifyClient(clientId int, msg authenticatedMessage) bool
+	// refreshKeys replaces the keys the other nodes use to authenticate
+	// messages to this replica and returns the public key they derive
+	// them from, nil if there are no session keys to refresh.
+	refreshKeys() []byte
+	// installKey switches to the keys a replica announced for an epoch
+	// later than the current one.
+	installKey(replicaId int, epoch int64, key []byte) bool
+}
+
+func newAuthenticator(keys *KeyConfig, self string, replicaId int) authenticator {
+	switch keys.AuthMode {
+	case MacAuthMode:
+		return newMacAuthenticator(keys, self, replicaId)
+	default:
+		sa := &signatureAuthenticator{}
+		sa.privateKey = keys.PrivateKey
+		sa.serverKeys = keys.ServerKeys
+		sa.clientKeys = keys.ClientKeys
+		return sa
+	}
+}
+
+func serverNode(id int) string {
+	return "server-" + strconv.Itoa(id)
+}
+
+func clientNode(id int) string {
+	return "client-" + strconv.Itoa(id)
+}
+
+// signatureAuthenticator signs every message with the Ed25519 key of the
+// sender.
+type signatureAuthenticator struct {
+	privateKey ed25519.PrivateKey
+	serverKeys []ed25519.PublicKey
+	clientKeys []ed25519.PublicKey
+}
+
+func (sa *signatureAuthenticator) authenticate(msg authenticatedMessage) {
+	signMessage(sa.privateKey, msg)
+}
+
+func (sa *signatureAuthenticator) verifyReplica(replicaId int, msg authenticatedMessage) bool {
+	if replicaId < 0 || replicaId >= len(sa.serverKeys) {
+		return false
+	}
+	return verifyMessage(sa.serverKeys[replicaId], msg)
+}
+
+func (sa *signatureAuthenticator) verifyClient(clientId int, msg authenticatedMessage) bool {
+	if clientId < 0 || clientId >= len(sa.clientKeys) {
+		return false
+	}
+	return verifyMessage(sa.clientKeys[clientId], msg)
+}
+
+// refreshKeys does nothing, there are no session keys and the signing keys
+// are never refreshed.
+func (sa *signatureAuthenticator) refreshKeys() []byte {
+	return nil
+}
+
+func (sa *signatureAuthenticator) installKey(replicaId int, epoch int64, key []byte) bool {
+	return false
+}
+
+// macAuthenticator attaches one HMAC-SHA256 per replica to every message,
+// keyed with the session key the sender shares with that replica. A
+// replica only checks the entry computed for itself.
+//
+// The keys for the messages to a replica are chosen by that replica. They
+// start as the keys derived from the static key pairs, a replica that
+// refreshes them derives them from a fresh key pair instead and the other
+// nodes switch to them once they learn its public key.
+type macAuthenticator struct {
+	mu         *sync.Mutex
+	me         int
+	self       string
+	macKey     *ecdh.PrivateKey
+	serverPubs []*ecdh.PublicKey
+	clientPubs []*ecdh.PublicKey
+	// keys of the messages to each replica
+	sendKeys [][]byte
+	epochs   []int64
+	// keys of the messages from each replica and client
+	serverKeys [][]byte
+	clientKeys [][]byte
+}
+
+// sessionKey derives the key shared by nodes a and b from their X25519
+// key agreement. Both ends derive the same key.
+func sessionKey(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, a, b string) []byte {
+	if priv == nil || pub == nil {
+		return nil
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil
+	}
+	if a > b {
+		a, b = b, a
+	}
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte("pbft-mac:" + a + ":" + b))
+	return mac.Sum(nil)
+}
+
+func newMacAuthenticator(keys *KeyConfig, self string, replicaId int) *macAuthenticator {
+	ma := &macAuthenticator{}
+	ma.mu = &sync.Mutex{}
+	ma.me = replicaId
+	ma.self = self
+	ma.macKey = keys.MacKey
+	ma.serverPubs = keys.ServerMacKeys
+	ma.clientPubs = keys.ClientMacKeys
+	ma.serverKeys = make([][]byte, len(keys.ServerMacKeys))
+	for i, pub := range keys.ServerMacKeys {
+		ma.serverKeys[i] = sessionKey(keys.MacKey, pub, self, serverNode(i))
+	}
+	ma.clientKeys = make([][]byte, len(keys.ClientMacKeys))
+	for i, pub := range keys.ClientMacKeys {
+		ma.clientKeys[i] = sessionKey(keys.MacKey, pub, self, clientNode(i))
+	}
+	ma.sendKeys = make([][]byte, len(ma.serverKeys))
+	copy(ma.sendKeys, ma.serverKeys)
+	ma.epochs = make([]int64, len(ma.serverKeys))
+	return ma
+}
+
+func computeMac(key []byte, content []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+func (ma *macAuthenticator) authenticate(msg authenticatedMessage) {
+	content := msg.content()
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	macs := make([][]byte, len(ma.sendKeys))
+	for i, key := range ma.sendKeys {
+		macs[i] = computeMac(key, content)
+	}
+	msg.setAuthenticator(macs)
+}
+
+func (ma *macAuthenticator) check(key []byte, msg authenticatedMessage) bool {
+	macs := msg.authenticator()
+	if key == nil || ma.me < 0 || ma.me >= len(macs) {
+		return false
+	}
+	return hmac.Equal(macs[ma.me], computeMac(key, msg.content()))
+}
+
+func (ma *macAuthenticator) verifyReplica(replicaId int, msg authenticatedMessage) bool {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if replicaId < 0 || replicaId >= len(ma.serverKeys) {
+		return false
+	}
+	return ma.check(ma.serverKeys[replicaId], msg)
+}
+
+func (ma *macAuthenticator) verifyClient(clientId int, msg authenticatedMessage) bool {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if clientId < 0 || clientId >= len(ma.clientKeys) {
+		return false
+	}
+	return ma.check(ma.clientKeys[clientId], msg)
+}
+
+func (ma *macAuthenticator) refreshKeys() []byte {
+	if ma.me < 0 {
+		return nil
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	for i, pub := range ma.serverPubs {
+		ma.serverKeys[i] = sessionKey(priv, pub, ma.self, serverNode(i))
+	}
+	for i, pub := range ma.clientPubs {
+		ma.clientKeys[i] = sessionKey(priv, pub, ma.self, clientNode(i))
+	}
+	// the messages to itself use the new key right away
+	ma.sendKeys[ma.me] = ma.serverKeys[ma.me]
+	return priv.PublicKey().Bytes()
+}
+
+func (ma *macAuthenticator) installKey(replicaId int, epoch int64, key []byte) bool {
+	pub, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return false
+	}
+
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if replicaId < 0 || replicaId >= len(ma.sendKeys) || epoch <= ma.epochs[replicaId] {
+		return false
+	}
+	ma.sendKeys[replicaId] = sessionKey(ma.macKey, pub, ma.self, serverNode(replicaId))
+	ma.epochs[replicaId] = epoch
+	return true
+}
@@ -1,44 +1,142 @@
 package pbft
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"sync"
 	"time"
 )
 
-// save operation as string
+const ReadOnlyTimeout = 1000
+const RetransmitTimeout = 2000
+
+type clientRequest struct {
+	args    *RequestArgs
+	command string
+	timer   *TimerWithCancel
+}
+
 type Client struct {
 	mu       *sync.Mutex
 	me       int
 	n        int
 	f        int
-	peers    []peerWrapper
-	requests map[int64]string
-	replies  map[int64]map[int]string
+	viewId   int
+	peers    []*peerWrapper
+	requests map[int64]*clientRequest
+	replies  map[int64]map[int]*ReplyArgs
+
+	// keys
+	privateKey ed25519.PrivateKey
+	serverKeys []ed25519.PublicKey
+	auth       authenticator
 
 	debugCh chan interface{}
 }
 
 func (c *Client) broadcast(rpcname string, rpcargs interface{}) {
-	reply := &DefaultReply{}
 	for _, peer := range c.peers {
 		p := peer
-		go p.Call("Pbft."+rpcname, rpcargs, reply)
+		go p.Call("Pbft."+rpcname, rpcargs, &DefaultReply{})
 	}
 }
 
-func (c *Client) newRequest(command string) {
+// newRequest sends an encoded operation, command is its readable form used
+// in the output. Read-only operations are executed by the replicas without
+// ordering and fall back to the ordered path if 2f+1 matching replies do
+// not arrive.
+func (c *Client) newRequest(operation []byte, command string, readOnly bool) {
 	requestArgs := &RequestArgs{}
 	requestArgs.ClientId = c.me
-	requestArgs.Operation = command
-	requestArgs.Timestamp = time.Now().Unix()
+	requestArgs.Operation = operation
+	requestArgs.Timestamp = time.Now().UnixNano()
+	requestArgs.ReadOnly = readOnly
+	c.auth.authenticate(requestArgs)
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.replies[requestArgs.Timestamp] = make(map[int]string)
-	c.requests[requestArgs.Timestamp] = command
-	c.broadcast("Request", requestArgs)
+	request := &clientRequest{}
+	request.args = requestArgs
+	request.command = command
+	c.replies[requestArgs.Timestamp] = make(map[int]*ReplyArgs)
+	c.requests[requestArgs.Timestamp] = request
+	if readOnly {
+		c.newReadOnlyTimer(request)
+		c.broadcast("Request", requestArgs)
+		return
+	}
+	c.sendToPrimary(request)
+}
+
+// sendToPrimary sends an ordered request to the primary of the last view
+// the client learned from the replies. If no result is accepted in time,
+// the request is retransmitted to all replicas.
+func (c *Client) sendToPrimary(request *clientRequest) {
+	primary := c.viewId % c.n
+	go c.peers[primary].Call("Pbft.Request", request.args, &DefaultReply{})
+	c.newRetransmitTimer(request)
+}
+
+func (c *Client) newRetransmitTimer(request *clientRequest) {
+	if request.timer != nil {
+		request.timer.Cancel()
+	}
+	timestamp := request.args.Timestamp
+	timer := NewTimerWithCancel(time.Duration(RetransmitTimeout * time.Millisecond))
+	timer.SetTimeout(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.requests[timestamp] != request || request.timer != timer {
+			return
+		}
+		c.debugPrint(fmt.Sprintf("Request timeout: Timestamp[%d], retransmit to all replicas\n", timestamp))
+		// a replica may have refreshed its keys since the request was sent
+		requestArgs := &RequestArgs{}
+		*requestArgs = *request.args
+		c.auth.authenticate(requestArgs)
+		request.args = requestArgs
+		c.broadcast("Request", request.args)
+		c.newRetransmitTimer(request)
+	})
+	timer.Start()
+	request.timer = timer
+}
+
+func (c *Client) newReadOnlyTimer(request *clientRequest) {
+	timestamp := request.args.Timestamp
+	request.timer = NewTimerWithCancel(time.Duration(ReadOnlyTimeout * time.Millisecond))
+	request.timer.SetTimeout(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.requests[timestamp] == request && request.args.ReadOnly {
+			c.debugPrint(fmt.Sprintf("Read-only request timeout: Timestamp[%d]\n", timestamp))
+			c.retryOrdered(request)
+		}
+	})
+	request.timer.Start()
+}
+
+// retryOrdered resends a read-only request through the ordered path. It
+// gets a new timestamp, so read-only replies that arrive late are not
+// counted as ordered ones.
+func (c *Client) retryOrdered(request *clientRequest) {
+	if request.timer != nil {
+		request.timer.Cancel()
+		request.timer = nil
+	}
+	delete(c.requests, request.args.Timestamp)
+	delete(c.replies, request.args.Timestamp)
+
+	requestArgs := &RequestArgs{}
+	*requestArgs = *request.args
+	requestArgs.ReadOnly = false
+	requestArgs.Timestamp = time.Now().UnixNano()
+	c.auth.authenticate(requestArgs)
+	request.args = requestArgs
+	c.replies[requestArgs.Timestamp] = make(map[int]*ReplyArgs)
+	c.requests[requestArgs.Timestamp] = request
+	c.sendToPrimary(request)
 }
 
 func (c *Client) saveReply(replyArgs *ReplyArgs) {
@@ -47,42 +145,69 @@ func (c *Client) saveReply(replyArgs *ReplyArgs) {
 		return
 	}
 
-	c.replies[timestamp][replyArgs.ReplicaId] = replyArgs.Result.(string)
+	c.replies[timestamp][replyArgs.ReplicaId] = replyArgs
 }
 
+// processReplies accepts a result with f+1 matching committed replies or
+// 2f+1 matching replies if some of them are tentative. Read-only results
+// are not ordered, so they always need 2f+1.
 func (c *Client) processReplies(timestamp int64) {
 	replies := c.replies[timestamp]
-	if replies == nil || len(replies) <= c.f {
+	request := c.requests[timestamp]
+	if replies == nil || request == nil || len(replies) <= c.f {
 		return
 	}
 
-	resultMap := make(map[string]int)
+	resultCnt := make(map[string]int)
+	committedCnt := make(map[string]int)
 	maxCnt := 0
-	maxResult := ""
-	for _, result := range replies {
-		resultMap[result]++
-		if resultMap[result] > maxCnt {
-			maxCnt = resultMap[result]
-			maxResult = result
+	for _, reply := range replies {
+		result := string(reply.Result)
+		resultCnt[result]++
+		if !reply.Tentative {
+			committedCnt[result]++
+		}
+		if resultCnt[result] > maxCnt {
+			maxCnt = resultCnt[result]
 		}
 	}
 
-	if maxCnt > c.f {
-		// accept Reply
-		c.acceptReply(timestamp, maxResult)
+	for result, cnt := range resultCnt {
+		if cnt > 2*c.f || (!request.args.ReadOnly && committedCnt[result] > c.f) {
+			// accept Reply
+			c.acceptReply(timestamp, result)
+			return
+		}
+	}
+
+	if request.args.ReadOnly && maxCnt+c.n-len(replies) <= 2*c.f {
+		// replies disagree
+		c.retryOrdered(request)
 	}
 }
 
 func (c *Client) acceptReply(timestamp int64, result string) {
-	if c.requests[timestamp] == "" {
+	request, ok := c.requests[timestamp]
+	if !ok {
 		return
 	}
 
+	// learn the current view once f+1 replies agree on it
+	views := make(map[int]int)
+	for _, reply := range c.replies[timestamp] {
+		views[reply.ViewId]++
+		if views[reply.ViewId] > c.f && reply.ViewId > c.viewId {
+			c.viewId = reply.ViewId
+		}
+	}
+
 	// output the result
-	command := c.requests[timestamp]
-	msg := fmt.Sprintf("Client [%d]: Command[%s] got Result[%s]\n", c.me, command, result)
+	msg := fmt.Sprintf("Client [%d]: Command[%s] got Result[%s]\n", c.me, request.command, result)
 	c.debugPrint(msg)
 
+	if request.timer != nil {
+		request.timer.Cancel()
+	}
 	delete(c.requests, timestamp)
 	delete(c.replies, timestamp)
 }
@@ -91,13 +216,16 @@ func (c *Client) debugPrint(msg string) {
 	c.debugCh <- msg
 }
 
-func MakeClient(id int, peers []peerWrapper, ch chan interface{}) *Client {
+func MakeClient(id int, peers []*peerWrapper, keys *KeyConfig, ch chan interface{}) *Client {
 	c := &Client{}
 	c.mu = &sync.Mutex{}
 	c.me = id
 	c.peers = peers
-	c.requests = make(map[int64]string)
-	c.replies = make(map[int64]map[int]string)
+	c.requests = make(map[int64]*clientRequest)
+	c.replies = make(map[int64]map[int]*ReplyArgs)
+	c.privateKey = keys.PrivateKey
+	c.serverKeys = keys.ServerKeys
+	c.auth = newAuthenticator(keys, clientNode(id), -1)
 	c.debugCh = ch
 	c.n = len(c.peers)
 	c.f = (c.n - 1) / 3
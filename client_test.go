@@ -0,0 +1,64 @@
+package pbft
+
+import "testing"
+
+// TestReadOnlyFallback sends a read-only request and answers it with
+// replies that disagree. Once 2f+1 matching replies are impossible the
+// client retries the request through the ordered path with a new
+// timestamp, and the read-only replies are dropped.
+func TestReadOnlyFallback(t *testing.T) {
+	serverPubs, serverPrivs := newTestKeys(4)
+	clientPubs, clientPrivs := newTestKeys(1)
+	keys := &KeyConfig{}
+	keys.PrivateKey = clientPrivs[0]
+	keys.ServerKeys = serverPubs
+	keys.ClientKeys = clientPubs
+	debugCh := make(chan interface{}, 1024)
+	go discard(debugCh)
+	c := MakeClient(0, createPeers([]string{"", "", "", ""}), keys, debugCh)
+
+	c.newRequest([]byte("get"), "get", true)
+	c.mu.Lock()
+	var readOnly *RequestArgs
+	for _, request := range c.requests {
+		readOnly = request.args
+	}
+	c.mu.Unlock()
+
+	reply := func(replicaId int, result string) {
+		args := &ReplyArgs{}
+		args.ReplicaId = replicaId
+		args.Timestamp = readOnly.Timestamp
+		args.Result = []byte(result)
+		signMessage(serverPrivs[replicaId], args)
+		err := c.Reply(args, &DefaultReply{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply(0, "a")
+	reply(1, "b")
+	c.mu.Lock()
+	if c.requests[readOnly.Timestamp] == nil {
+		t.Error("read-only request retried while 2f+1 matching replies were possible")
+	}
+	c.mu.Unlock()
+	reply(2, "c")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.requests[readOnly.Timestamp] != nil || c.replies[readOnly.Timestamp] != nil {
+		t.Error("read-only request and its replies kept after the fallback")
+	}
+	if len(c.requests) != 1 {
+		t.Fatalf("%d requests pending, expected the ordered retry", len(c.requests))
+	}
+	for timestamp, request := range c.requests {
+		if request.args.ReadOnly || timestamp == readOnly.Timestamp || request.args.Timestamp != timestamp {
+			t.Errorf("retry is read-only or kept timestamp %d", readOnly.Timestamp)
+		}
+		if request.timer != nil {
+			request.timer.Cancel()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package pbft
 
 import (
+	"errors"
 	"time"
 )
 
@@ -33,8 +34,11 @@ func (t *TimerWithCancel) SetTimeout(f func()) {
 	t.f = f
 }
 
+// Cancel stops the timer. It does nothing if the timeout already fired.
 func (t *TimerWithCancel) Cancel() {
-	t.c <- nil
+	if t.t.Stop() {
+		close(t.c)
+	}
 }
 
 type PbftPhase int
@@ -45,12 +49,17 @@ const (
 	PbftPhasecommitted
 )
 
+// LogEntry holds a batch of requests ordered at SeqId and, once it is
+// executed, the reply to each of them. Signature is the signature of the
+// pre-prepare by the primary of ViewId.
 type LogEntry struct {
-	SeqId   int
-	ViewId  int
-	Phase   PbftPhase
-	Request RequestArgs
-	Reply   ReplyArgs
+	SeqId     int
+	ViewId    int
+	Phase     PbftPhase
+	Digest    string
+	Requests  []RequestArgs
+	Replies   []ReplyArgs
+	Signature []byte
 }
 
 type DefaultReply struct {
@@ -58,48 +67,83 @@ type DefaultReply struct {
 }
 
 type RequestArgs struct {
-	Operation interface{}
-	Timestamp int64
-	ClientId  int
+	Operation     []byte
+	Timestamp     int64
+	ClientId      int
+	ReadOnly      bool
+	Signature     []byte
+	Authenticator [][]byte
 }
 
 type ReplyArgs struct {
 	ViewId    int
 	Timestamp int64
 	ReplicaId int
-	Result    interface{}
+	Result    []byte
+	Tentative bool
+	Signature []byte
 }
 
 type PrePrepareAgrs struct {
-	ViewId  int
-	SeqId   int
-	Digest  string
-	Request RequestArgs
-}
-
-type PrepareArgs struct {
 	ViewId    int
 	SeqId     int
 	Digest    string
-	ReplicaId int
+	Requests  []RequestArgs
+	Signature []byte
+}
+
+type PrepareArgs struct {
+	ViewId        int
+	SeqId         int
+	Digest        string
+	ReplicaId     int
+	Signature     []byte
+	Authenticator [][]byte
 }
 
 type CommitArgs struct {
-	ViewId    int
-	SeqId     int
-	Digest    string
-	ReplicaId int
+	ViewId        int
+	SeqId         int
+	Digest        string
+	ReplicaId     int
+	Signature     []byte
+	Authenticator [][]byte
 }
 
 type CheckpointArgs struct {
 	LastCommitted int
 	Digest        string
 	ReplicaId     int
+	Signature     []byte
+}
+
+type FetchStateArgs struct {
+	ReplicaId int
+	SeqId     int
 }
 
+type FetchStateReply struct {
+	SeqId    int
+	Snapshot []byte
+	Proof    []CheckpointArgs
+	Err      string
+}
+
+type FetchLogArgs struct {
+	ReplicaId int
+	SeqId     int
+}
+
+type FetchLogReply struct {
+	Entries []LogEntry
+	Err     string
+}
+
+// PreparedRequest proves that a request prepared: the pre-prepare signed
+// by the primary of its view and 2f matching prepares signed by backups.
 type PreparedRequest struct {
-	Request  LogEntry
-	Prepares map[int]string
+	Preprepare PrePrepareAgrs
+	Prepares   []PrepareArgs
 }
 
 type ViewChangeArgs struct {
@@ -107,13 +151,42 @@ type ViewChangeArgs struct {
 	ReplicaId            int
 	LastCheckpointSeqId  int
 	LastCheckpointDigest string
+	LastCheckpointProof  []CheckpointArgs
 	PreparedRequestSet   map[int]PreparedRequest
+	Signature            []byte
 }
 
+// NewViewArgs carries the view-change messages the new primary based the
+// view on, so every backup can recompute NewPreprepares from them.
 type NewViewArgs struct {
-	ViewId             int
-	PreparedRequestSet map[int]PreparedRequest
-	NewPreprepares     map[int]PrePrepareAgrs
+	ViewId         int
+	ViewChanges    []ViewChangeArgs
+	NewPreprepares map[int]PrePrepareAgrs
+	Signature      []byte
+}
+
+// NewKeyArgs announces the public key a replica derives the keys of the
+// messages to it from after refreshing them. Epoch orders the
+// announcements of a replica.
+type NewKeyArgs struct {
+	ReplicaId int
+	Epoch     int64
+	Key       []byte
+	Signature []byte
+}
+
+type QueryStableArgs struct {
+	ReplicaId int
+}
+
+// QueryStableReply is the view of a replica and its last stable
+// checkpoint with the proof.
+type QueryStableReply struct {
+	ViewId int
+	SeqId  int
+	Digest string
+	Proof  []CheckpointArgs
+	Err    string
 }
 
 type MaliciousBehaviorMode int
@@ -124,3 +197,58 @@ const (
 	PartiallyMaliciousMode
 	MaliciousMode
 )
+
+// AuthMode selects how the normal-case messages are authenticated. In
+// SignatureAuthMode requests, prepares and commits are signed. In
+// MacAuthMode they carry a vector of MACs, one per replica, but the
+// backups still sign their prepares, view-change certificates are made of
+// them. So MAC mode saves the signatures of the commits and of the
+// requests, an entry still costs one signature per backup. Pre-prepares,
+// replies, checkpoints and view-change messages are signed in both modes.
+type AuthMode int
+
+const (
+	SignatureAuthMode = iota
+	MacAuthMode
+)
+
+const DefaultCheckpointInterval = 10
+const DefaultLogWindow = 2 * DefaultCheckpointInterval
+
+// Config holds the protocol parameters every replica of a cluster must
+// agree on. The log window is the distance between the low and the high
+// watermark, zero values select the defaults. The recovery interval is the
+// time in milliseconds between two proactive recoveries of a replica, zero
+// disables them. A recovery only refreshes the MAC session keys, the
+// signing keys are never refreshed, so recoveries need MacAuthMode.
+type Config struct {
+	CheckpointInterval int
+	LogWindow          int
+	RecoveryInterval   int
+}
+
+// Validate fills in the defaults and checks that the next checkpoint
+// always fits into the log window, otherwise the window never advances.
+// Proactive recoveries are rejected unless the replicas authenticate with
+// MACs, in signature mode a recovery would refresh no keys at all.
+func (config *Config) Validate(authMode AuthMode) error {
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = DefaultCheckpointInterval
+	}
+	if config.LogWindow == 0 {
+		config.LogWindow = DefaultLogWindow * config.CheckpointInterval / DefaultCheckpointInterval
+	}
+	if config.CheckpointInterval < 0 {
+		return errors.New("checkpoint interval must be positive")
+	}
+	if config.LogWindow < config.CheckpointInterval {
+		return errors.New("log window must not be smaller than the checkpoint interval")
+	}
+	if config.RecoveryInterval < 0 {
+		return errors.New("recovery interval must be positive")
+	}
+	if config.RecoveryInterval > 0 && authMode != MacAuthMode {
+		return errors.New("proactive recovery needs the MAC auth mode")
+	}
+	return nil
+}
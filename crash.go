@@ -0,0 +1,52 @@
+package pbft
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// Crash points stop a replica after it logged a message and before it
+// sent it, the way a power failure would. They exercise the recovery from
+// the storage.
+const (
+	CrashPreprepare = "preprepare"
+	CrashPrepare    = "prepare"
+	CrashCommit     = "commit"
+	CrashViewChange = "viewchange"
+)
+
+// setCrashPoint arms a crash point, an empty point disarms it.
+func (pf *Pbft) setCrashPoint(point string) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	switch point {
+	case "", CrashPreprepare, CrashPrepare, CrashCommit, CrashViewChange:
+		pf.crashPoint = point
+		return nil
+	}
+	return errors.New("Invalid crash point")
+}
+
+// crashAt exits the process if the crash point is armed. Everything not
+// in the storage is lost, the pending debug output included. A replica
+// with a crash hook crashes in-process instead.
+func (pf *Pbft) crashAt(point string) {
+	if pf.crashPoint != point {
+		return
+	}
+	log.Printf("Replica[%d] crashed at %s\n", pf.me, point)
+	if pf.onCrash == nil {
+		os.Exit(2)
+	}
+	pf.crash()
+}
+
+// crash stops a replica that runs in the same process as others. It
+// loses its storage and the crash hook cuts it off from the network, a
+// replica made from the same storage takes its place.
+func (pf *Pbft) crash() {
+	pf.crashPoint = ""
+	pf.storage = nil
+	pf.onCrash()
+}
@@ -0,0 +1,189 @@
+package pbft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// The crash tests run a cluster with memory storages in the test process.
+// Every scenario crashes a replica at a crash point and restarts it from
+// its storage, or makes it run a proactive recovery. The replicas must
+// converge to the same state with every request applied exactly once, the
+// echo state machine counts the operations it applied.
+
+type crashScenario struct {
+	point  string
+	victim int
+	// the primary is killed as well, so the backups start a view change
+	killPrimary bool
+}
+
+// proactiveRecovery is the point of the scenarios that recover the victim
+// instead of crashing it.
+const proactiveRecovery = "recovery"
+
+var crashScenarios = []crashScenario{
+	{CrashPreprepare, 0, false},
+	{CrashPrepare, 1, false},
+	{CrashCommit, 2, false},
+	{CrashViewChange, 3, true},
+	{proactiveRecovery, 0, false},
+	{proactiveRecovery, 1, false},
+}
+
+const crashTestRequests = 30
+
+func TestCrash(t *testing.T) {
+	if testing.Short() {
+		t.Skip("crash test skipped in short mode")
+	}
+	for _, scenario := range crashScenarios {
+		scenario := scenario
+		t.Run(fmt.Sprintf("%s-%d", scenario.point, scenario.victim), func(t *testing.T) {
+			runCrashScenario(t, scenario)
+		})
+	}
+}
+
+func runCrashScenario(t *testing.T, scenario crashScenario) {
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 20
+	// recoveries only refresh keys in MAC mode
+	authMode := AuthMode(SignatureAuthMode)
+	if scenario.point == proactiveRecovery {
+		authMode = MacAuthMode
+	}
+	c := newTestCluster(t, 4, 1, config, authMode, true)
+
+	requests := 0
+	crashed := crashTestRequests / 2
+	for ; requests < crashed; requests++ {
+		err := c.request(0, fmt.Sprintf("op %d", requests))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	command := fmt.Sprintf("op %d", requests)
+	if scenario.point == proactiveRecovery {
+		c.clients[0].newRequest([]byte(command), command, false)
+		go c.replicas[scenario.victim].recover()
+	} else {
+		c.crash(scenario, command)
+	}
+	err := c.await(0, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests++
+
+	for ; requests < crashTestRequests; requests++ {
+		err := c.request(0, fmt.Sprintf("op %d", requests))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests = c.converge(requests)
+	for id, pf := range c.replicas {
+		pf.mu.Lock()
+		applied := pf.sm.(*EchoStateMachine).Applied
+		pf.mu.Unlock()
+		if applied != requests {
+			t.Errorf("replica %d applied %d operations, %d requests were sent", id, applied, requests)
+		}
+	}
+}
+
+// crash makes the victim crash while ordering command and restarts it
+// from its storage before the command completes.
+func (c *testCluster) crash(scenario crashScenario, command string) {
+	err := c.replicas[scenario.victim].setCrashPoint(scenario.point)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if scenario.killPrimary {
+		c.kill(0)
+	}
+
+	c.clients[0].newRequest([]byte(command), command, false)
+	err = c.waitCrashed(scenario.victim)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.startReplica(scenario.victim)
+	if scenario.killPrimary {
+		c.startReplica(0)
+	}
+}
+
+// converge waits until every replica executed up to the same sequence id
+// with the same state and returns the number of requests sent. Replicas
+// that lag behind catch up at the next checkpoint, so a filler request is
+// sent while they differ.
+func (c *testCluster) converge(requests int) int {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		executed := make(map[string]bool)
+		for _, pf := range c.replicas {
+			pf.mu.Lock()
+			executed[fmt.Sprintf("%d %s", pf.lastExecuted, pf.stateDigest())] = true
+			pf.mu.Unlock()
+		}
+		if len(executed) == 1 {
+			return requests
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("replicas did not converge: %v", executed)
+		}
+
+		err := c.request(0, fmt.Sprintf("filler %d", requests))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		requests++
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// TestCatchUp kills a replica, orders more than a log window of requests
+// without it and restarts it with an empty state. The checkpoints of the
+// others are above its log window, it has to notice that it fell behind
+// and fetch the state.
+func TestCatchUp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("crash test skipped in short mode")
+	}
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 20
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, false)
+
+	c.kill(3)
+	requests := 0
+	for ; requests < 3*config.LogWindow; requests++ {
+		err := c.request(0, fmt.Sprintf("op %d", requests))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.startReplica(3)
+	for ; requests < 6*config.LogWindow; requests++ {
+		err := c.request(0, fmt.Sprintf("op %d", requests))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests = c.converge(requests)
+	for id, pf := range c.replicas {
+		pf.mu.Lock()
+		applied := pf.sm.(*EchoStateMachine).Applied
+		pf.mu.Unlock()
+		if applied != requests {
+			t.Errorf("replica %d applied %d operations, %d requests were sent", id, applied, requests)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package pbft
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// encodeRequest returns the canonical encoding of a request: the
+// length-prefixed operation followed by the timestamp and the client id as
+// fixed-width big-endian integers and the read-only flag.
+func encodeRequest(args *RequestArgs) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(len(args.Operation)))
+	buf.Write(args.Operation)
+	binary.Write(buf, binary.BigEndian, args.Timestamp)
+	binary.Write(buf, binary.BigEndian, int64(args.ClientId))
+	binary.Write(buf, binary.BigEndian, args.ReadOnly)
+	return buf.Bytes()
+}
+
+// requestDigest returns the hex encoded SHA-256 of the canonical encoding
+// of the request.
+func requestDigest(args *RequestArgs) string {
+	sum := sha256.Sum256(encodeRequest(args))
+	return hex.EncodeToString(sum[:])
+}
+
+// batchDigest returns the hex encoded SHA-256 of the number of requests in
+// a batch followed by the digest of each of them.
+func batchDigest(requests []RequestArgs) string {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(len(requests)))
+	for i := range requests {
+		h.Write([]byte(requestDigest(&requests[i])))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// KeyConfig holds the private keys of the local node and the public keys
+// of every replica and client, indexed by id. The X25519 keys are only
+// used to derive MAC session keys in MacAuthMode, the Ed25519 keys are
+// needed in both modes, see AuthMode for the signatures MAC mode keeps.
+type KeyConfig struct {
+	AuthMode      AuthMode
+	PrivateKey    ed25519.PrivateKey
+	ServerKeys    []ed25519.PublicKey
+	ClientKeys    []ed25519.PublicKey
+	MacKey        *ecdh.PrivateKey
+	ServerMacKeys []*ecdh.PublicKey
+	ClientMacKeys []*ecdh.PublicKey
+}
+
+type signedMessage interface {
+	content() []byte
+	signature() []byte
+	setSignature(sig []byte)
+}
+
+// encodeMessage returns the bytes covered by the signature of a message:
+// the rpc name followed by the JSON encoding of the message with its
+// signature field cleared.
+func encodeMessage(rpcname string, msg interface{}) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return append([]byte(rpcname+":"), data...)
+}
+
+func signMessage(key ed25519.PrivateKey, msg signedMessage) {
+	if len(key) != ed25519.PrivateKeySize {
+		return
+	}
+	msg.setSignature(ed25519.Sign(key, msg.content()))
+}
+
+func verifyMessage(key ed25519.PublicKey, msg signedMessage) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	content := msg.content()
+	if content == nil {
+		return false
+	}
+	return ed25519.Verify(key, content, msg.signature())
+}
+
+func (args RequestArgs) content() []byte {
+	args.Signature = nil
+	args.Authenticator = nil
+	return encodeMessage("Request", args)
+}
+
+func (args *RequestArgs) signature() []byte { return args.Signature }
+
+func (args *RequestArgs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args *RequestArgs) authenticator() [][]byte { return args.Authenticator }
+
+func (args *RequestArgs) setAuthenticator(macs [][]byte) { args.Authenticator = macs }
+
+func (args ReplyArgs) content() []byte {
+	args.Signature = nil
+	return encodeMessage("Reply", args)
+}
+
+func (args *ReplyArgs) signature() []byte { return args.Signature }
+
+func (args *ReplyArgs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args PrePrepareAgrs) content() []byte {
+	args.Signature = nil
+	return encodeMessage("Preprepare", args)
+}
+
+func (args *PrePrepareAgrs) signature() []byte { return args.Signature }
+
+func (args *PrePrepareAgrs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args PrepareArgs) content() []byte {
+	args.Signature = nil
+	args.Authenticator = nil
+	return encodeMessage("Prepare", args)
+}
+
+func (args *PrepareArgs) signature() []byte { return args.Signature }
+
+func (args *PrepareArgs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args *PrepareArgs) authenticator() [][]byte { return args.Authenticator }
+
+func (args *PrepareArgs) setAuthenticator(macs [][]byte) { args.Authenticator = macs }
+
+func (args CommitArgs) content() []byte {
+	args.Signature = nil
+	args.Authenticator = nil
+	return encodeMessage("Commit", args)
+}
+
+func (args *CommitArgs) signature() []byte { return args.Signature }
+
+func (args *CommitArgs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args *CommitArgs) authenticator() [][]byte { return args.Authenticator }
+
+func (args *CommitArgs) setAuthenticator(macs [][]byte) { args.Authenticator = macs }
+
+func (args CheckpointArgs) content() []byte {
+	args.Signature = nil
+	return encodeMessage("Checkpoint", args)
+}
+
+func (args *CheckpointArgs) signature() []byte { return args.Signature }
+
+func (args *CheckpointArgs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args ViewChangeArgs) content() []byte {
+	args.Signature = nil
+	return encodeMessage("ViewChange", args)
+}
+
+func (args *ViewChangeArgs) signature() []byte { return args.Signature }
+
+func (args *ViewChangeArgs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args NewViewArgs) content() []byte {
+	args.Signature = nil
+	return encodeMessage("NewView", args)
+}
+
+func (args *NewViewArgs) signature() []byte { return args.Signature }
+
+func (args *NewViewArgs) setSignature(sig []byte) { args.Signature = sig }
+
+func (args NewKeyArgs) content() []byte {
+	args.Signature = nil
+	return encodeMessage("NewKey", args)
+}
+
+func (args *NewKeyArgs) signature() []byte { return args.Signature }
+
+func (args *NewKeyArgs) setSignature(sig []byte) { args.Signature = sig }
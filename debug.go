@@ -1,6 +1,7 @@
 package pbft
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -70,7 +71,20 @@ id:			%d
 n:			%d
 viewId:		%d
 seqId:		%d
-`, info["id"].(int), info["n"].(int), info["seqId"].(int), info["seqId"].(int))
+checkpoint:	%d
+executed:	%d
+state:		%s
+`, info["id"].(int), info["n"].(int), info["viewId"].(int), info["seqId"].(int),
+		info["lastCheckpointSeqId"].(int), info["lastExecuted"].(int), info["stateDigest"].(string))
+	msg += fmt.Sprintf("window:		%d/%d used, peak %d\n", info["windowUsed"].(int), info["logWindow"].(int), info["windowPeak"].(int))
+	msg += fmt.Sprintf("held back:	%d pending, %d in total, %d future preprepares\n",
+		info["pendingRequests"].(int), info["heldBackRequests"].(int), info["futurePreprepares"].(int))
+	if diverged := info["divergedSeqId"].(int); diverged != 0 {
+		msg += fmt.Sprintf("diverged:	checkpoint %d\n", diverged)
+	}
+	if recovery := info["recoverySeqId"].(int); recovery != 0 {
+		msg += fmt.Sprintf("recovering:	until checkpoint %d\n", recovery)
+	}
 	conn.Write([]byte(msg))
 }
 
@@ -104,10 +118,30 @@ func (pds *PbftDebugServer) handleMaliciousBehavior(conn net.Conn, args []string
 	conn.Write([]byte(fmt.Sprintf("malicious behavior set. rpcname[%s] mode[%d]\n", rpcname, mbmode)))
 }
 
+func (pds *PbftDebugServer) handleCrash(conn net.Conn, args []string) {
+	point := ""
+	if len(args) > 1 {
+		point = args[1]
+	}
+
+	err := pds.pbftServer.setCrashPoint(point)
+	if err != nil {
+		conn.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("crash point set. point[%s]\n", point)))
+}
+
 func (pds *PbftDebugServer) handleConnArgs(conn net.Conn, args []string) {
 	switch args[0] {
 	case "mb":
 		pds.handleMaliciousBehavior(conn, args)
+	case "crash":
+		pds.handleCrash(conn, args)
+	case "recover":
+		conn.Write([]byte("Recovering...\n"))
+		go pds.pbftServer.recover()
 	case "kill":
 		conn.Write([]byte("Kill Server...\n"))
 		conn.Close()
@@ -144,9 +178,48 @@ type ClientDebugServer struct {
 	clientServer *Client
 }
 
+// parseKVOperation parses the arguments of a request:
+// get key | put key value | del key | cas key expected value | scan start [end]
+func parseKVOperation(args []string) (*KVOperation, error) {
+	if len(args) < 2 {
+		return nil, errors.New("Arguments not enough: get|put|del|cas|scan key ...")
+	}
+
+	op := &KVOperation{}
+	op.Key = args[1]
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		op.Type = KVGet
+	case args[0] == "put" && len(args) == 3:
+		op.Type = KVPut
+		op.Value = args[2]
+	case args[0] == "del" && len(args) == 2:
+		op.Type = KVDelete
+	case args[0] == "cas" && len(args) == 4:
+		op.Type = KVCompareAndSwap
+		op.Expected = args[2]
+		op.Value = args[3]
+	case args[0] == "scan" && len(args) <= 3:
+		op.Type = KVScan
+		if len(args) == 3 {
+			op.EndKey = args[2]
+		}
+	default:
+		return nil, errors.New("Invalid request: " + strings.Join(args, " "))
+	}
+	return op, nil
+}
+
 func (cds *ClientDebugServer) handleRequest(conn net.Conn, args []string) {
+	op, err := parseKVOperation(args[1:])
+	if err != nil {
+		conn.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
 	request := strings.Join(args[1:], " ")
-	cds.clientServer.newRequest(request)
+	readOnly := op.Type == KVGet || op.Type == KVScan
+	cds.clientServer.newRequest(EncodeKVOperation(op), request, readOnly)
 	reply := fmt.Sprintf("Request[%s] sent.\n", request)
 	conn.Write([]byte(reply))
 }
@@ -0,0 +1,338 @@
+package pbft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy selects when the write-ahead log is flushed to disk.
+type SyncPolicy int
+
+const (
+	// every record is flushed before the replica acts on it
+	SyncAlways = iota
+	// records are flushed every sync interval, a crash may lose the
+	// promises of the last interval
+	SyncInterval
+	// flushing is left to the operating system
+	SyncNever
+)
+
+const DefaultSyncInterval = 10
+const DefaultSnapshotRetention = 2
+
+const walFileName = "wal"
+const snapshotFilePrefix = "snapshot-"
+
+// FileStorage keeps the log in a write-ahead log file and the snapshots of
+// the stable checkpoints in files next to it, named after their sequence
+// id. Each record is framed by its length and CRC-32, so a record torn by
+// a crash is detected on replay and cut off.
+type FileStorage struct {
+	mu       *sync.Mutex
+	dir      string
+	file     *os.File
+	policy   SyncPolicy
+	interval time.Duration
+	retain   int
+	dirty    bool
+	closed   chan interface{}
+}
+
+// NewFileStorage opens the storage in dir, creating it if needed. The
+// interval is in milliseconds and only used by SyncInterval, retain is the
+// number of snapshots kept on disk. Zero values select the defaults.
+func NewFileStorage(dir string, policy SyncPolicy, interval int, retain int) (*FileStorage, error) {
+	if policy < SyncAlways || policy > SyncNever {
+		return nil, errors.New("invalid sync policy")
+	}
+	if interval == 0 {
+		interval = DefaultSyncInterval
+	}
+	if interval < 0 {
+		return nil, errors.New("sync interval must be positive")
+	}
+	if retain == 0 {
+		retain = DefaultSnapshotRetention
+	}
+	if retain < 0 {
+		return nil, errors.New("snapshot retention must be positive")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FileStorage{}
+	fs.mu = &sync.Mutex{}
+	fs.dir = dir
+	fs.file = file
+	fs.policy = policy
+	fs.interval = time.Duration(interval) * time.Millisecond
+	fs.retain = retain
+	fs.closed = make(chan interface{})
+	if policy == SyncInterval {
+		go fs.syncLoop()
+	}
+	return fs, nil
+}
+
+// Replay leaves the file positioned after the last intact record, new
+// records overwrite a torn one.
+func (fs *FileStorage) Replay(apply func(record *Record)) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, err := fs.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(fs.file)
+	offset := int64(0)
+	header := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		data := make([]byte, size)
+		_, err = io.ReadFull(reader, data)
+		if err != nil || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+
+		record := &Record{}
+		if json.Unmarshal(data, record) != nil {
+			break
+		}
+		apply(record)
+		offset += int64(len(header)) + int64(size)
+	}
+
+	// drop a torn record at the tail, it was never acted on
+	err = fs.file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = fs.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func encodeFrame(record *Record) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[8:], data)
+	return frame, nil
+}
+
+func (fs *FileStorage) Append(record *Record) error {
+	frame, err := encodeFrame(record)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return errors.New("storage closed")
+	}
+	_, err = fs.file.Write(frame)
+	if err != nil {
+		return err
+	}
+	switch fs.policy {
+	case SyncAlways:
+		return fs.file.Sync()
+	case SyncInterval:
+		fs.dirty = true
+	}
+	return nil
+}
+
+// syncLoop flushes the records appended since the last tick.
+func (fs *FileStorage) syncLoop() {
+	ticker := time.NewTicker(fs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.mu.Lock()
+			if fs.dirty && fs.file != nil {
+				fs.file.Sync()
+				fs.dirty = false
+			}
+			fs.mu.Unlock()
+		case <-fs.closed:
+			return
+		}
+	}
+}
+
+// Compact writes the records to a new log file and renames it over the
+// old one, so a crash leaves either of them.
+func (fs *FileStorage) Compact(records []*Record) error {
+	buf := make([]byte, 0)
+	for _, record := range records {
+		frame, err := encodeFrame(record)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, frame...)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return errors.New("storage closed")
+	}
+	path := filepath.Join(fs.dir, walFileName)
+	err := writeFileSync(path, buf)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fs.file.Close()
+	fs.file = file
+	fs.dirty = false
+	return nil
+}
+
+// SaveSnapshot writes the snapshot of a stable checkpoint and removes the
+// oldest snapshots beyond the retention. The file holds the CRC-32 of the
+// snapshot followed by the snapshot.
+func (fs *FileStorage) SaveSnapshot(seqId int, snapshot []byte) error {
+	data := make([]byte, 4+len(snapshot))
+	binary.BigEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(snapshot))
+	copy(data[4:], snapshot)
+
+	err := writeFileSync(filepath.Join(fs.dir, snapshotFilePrefix+strconv.Itoa(seqId)), data)
+	if err != nil {
+		return err
+	}
+
+	seqIds, err := fs.snapshotSeqIds()
+	if err != nil {
+		return err
+	}
+	for i := fs.retain; i < len(seqIds); i++ {
+		os.Remove(filepath.Join(fs.dir, snapshotFilePrefix+strconv.Itoa(seqIds[i])))
+	}
+	return nil
+}
+
+// LoadSnapshot returns the newest snapshot that is intact.
+func (fs *FileStorage) LoadSnapshot() (int, []byte, error) {
+	seqIds, err := fs.snapshotSeqIds()
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, seqId := range seqIds {
+		data, err := ioutil.ReadFile(filepath.Join(fs.dir, snapshotFilePrefix+strconv.Itoa(seqId)))
+		if err != nil || len(data) < 4 || crc32.ChecksumIEEE(data[4:]) != binary.BigEndian.Uint32(data[0:4]) {
+			continue
+		}
+		return seqId, data[4:], nil
+	}
+	return 0, nil, nil
+}
+
+// snapshotSeqIds returns the sequence ids of the snapshot files, newest
+// first.
+func (fs *FileStorage) snapshotSeqIds() ([]int, error) {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqIds := make([]int, 0)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), snapshotFilePrefix) {
+			continue
+		}
+		seqId, err := strconv.Atoi(strings.TrimPrefix(file.Name(), snapshotFilePrefix))
+		if err != nil {
+			continue
+		}
+		seqIds = append(seqIds, seqId)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(seqIds)))
+	return seqIds, nil
+}
+
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return errors.New("storage already closed")
+	}
+	close(fs.closed)
+	err := fs.file.Sync()
+	fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+// writeFileSync writes data to a temporary file first and renames it to
+// path, so a crash leaves either the old or the new content.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes a directory, so a file renamed into it survives a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
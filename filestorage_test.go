@@ -0,0 +1,193 @@
+package pbft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newTestFileStorage(t *testing.T, dir string) *FileStorage {
+	fs, err := NewFileStorage(dir, SyncAlways, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func metadataRecord(viewId int) *Record {
+	record := &Record{}
+	record.Type = MetadataRecord
+	record.Metadata = &Metadata{}
+	record.Metadata.ViewId = viewId
+	return record
+}
+
+// replayViews replays the storage and returns the views of its metadata
+// records.
+func replayViews(t *testing.T, fs *FileStorage) []int {
+	views := make([]int, 0)
+	err := fs.Replay(func(record *Record) {
+		views = append(views, record.Metadata.ViewId)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return views
+}
+
+func appendViews(t *testing.T, fs *FileStorage, views ...int) {
+	for _, viewId := range views {
+		err := fs.Append(metadataRecord(viewId))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkViews(t *testing.T, views []int, expected ...int) {
+	if len(views) != len(expected) {
+		t.Fatalf("replayed views %v, expected %v", views, expected)
+	}
+	for i := range views {
+		if views[i] != expected[i] {
+			t.Fatalf("replayed views %v, expected %v", views, expected)
+		}
+	}
+}
+
+// TestFileStorageTornTail cuts the last record of the log in half, as a
+// crash during the write would. Replay stops before it and truncates the
+// file, the next record is appended after the intact ones.
+func TestFileStorageTornTail(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestFileStorage(t, dir)
+	appendViews(t, fs, 1, 2, 3)
+	fs.Close()
+
+	path := filepath.Join(dir, walFileName)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, info.Size()-5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs = newTestFileStorage(t, dir)
+	checkViews(t, replayViews(t, fs), 1, 2)
+	appendViews(t, fs, 4)
+	checkViews(t, replayViews(t, fs), 1, 2, 4)
+	fs.Close()
+}
+
+// TestFileStorageCompact replaces the log by a shorter one. The records
+// appended afterwards go to the new file and survive a reopen.
+func TestFileStorageCompact(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestFileStorage(t, dir)
+	appendViews(t, fs, 1, 2, 3)
+	err := fs.Compact([]*Record{metadataRecord(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendViews(t, fs, 4)
+	checkViews(t, replayViews(t, fs), 3, 4)
+	fs.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, walFileName+".tmp")); !os.IsNotExist(err) {
+		t.Error("temporary log file left behind")
+	}
+	fs = newTestFileStorage(t, dir)
+	checkViews(t, replayViews(t, fs), 3, 4)
+	fs.Close()
+}
+
+// TestFileStorageReopen closes the storage and opens the directory again.
+// The closed storage refuses records, the reopened one replays the old
+// ones and appends after them.
+func TestFileStorageReopen(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestFileStorage(t, dir)
+	appendViews(t, fs, 1, 2)
+	err := fs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Append(metadataRecord(3)) == nil {
+		t.Error("closed storage accepted a record")
+	}
+	if fs.Close() == nil {
+		t.Error("storage closed twice")
+	}
+
+	fs = newTestFileStorage(t, dir)
+	checkViews(t, replayViews(t, fs), 1, 2)
+	appendViews(t, fs, 3)
+	fs.Close()
+
+	fs = newTestFileStorage(t, dir)
+	checkViews(t, replayViews(t, fs), 1, 2, 3)
+	fs.Close()
+}
+
+// TestSnapshotRetention saves more snapshots than are retained. Only the
+// newest ones stay on disk and the newest one is loaded.
+func TestSnapshotRetention(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir, SyncAlways, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	for seqId := 10; seqId <= 40; seqId += 10 {
+		err := fs.SaveSnapshot(seqId, []byte(strconv.Itoa(seqId)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seqIds, err := fs.snapshotSeqIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqIds) != 2 || seqIds[0] != 40 || seqIds[1] != 30 {
+		t.Errorf("snapshots %v kept, expected 40 and 30", seqIds)
+	}
+	seqId, snapshot, err := fs.LoadSnapshot()
+	if err != nil || seqId != 40 || string(snapshot) != "40" {
+		t.Errorf("loaded snapshot %d %q: %v", seqId, snapshot, err)
+	}
+}
+
+// TestLoadCorruptedSnapshot flips a byte of the newest snapshot. It fails
+// its checksum, so the one before it is loaded.
+func TestLoadCorruptedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestFileStorage(t, dir)
+	defer fs.Close()
+	for seqId := 10; seqId <= 20; seqId += 10 {
+		err := fs.SaveSnapshot(seqId, []byte(strconv.Itoa(seqId)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, snapshotFilePrefix+"20")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seqId, snapshot, err := fs.LoadSnapshot()
+	if err != nil || seqId != 10 || string(snapshot) != "10" {
+		t.Errorf("loaded snapshot %d %q: %v, expected snapshot 10", seqId, snapshot, err)
+	}
+}
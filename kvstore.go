@@ -0,0 +1,161 @@
+package pbft
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+type KVOpType int
+
+const (
+	KVGet = iota
+	KVPut
+	KVDelete
+	KVCompareAndSwap
+	KVScan
+)
+
+// KVOperation is the operation encoding understood by KVStore. Scan
+// returns the pairs with Key <= key < EndKey in key order, an empty EndKey
+// scans to the end. CompareAndSwap sets Key to Value only if its current
+// value is Expected, an empty Expected matches a missing key.
+type KVOperation struct {
+	Type     KVOpType
+	Key      string
+	Value    string
+	Expected string
+	EndKey   string
+}
+
+type KVPair struct {
+	Key   string
+	Value string
+}
+
+type KVResult struct {
+	Ok    bool
+	Value string   `json:",omitempty"`
+	Pairs []KVPair `json:",omitempty"`
+	Err   string   `json:",omitempty"`
+}
+
+func EncodeKVOperation(op *KVOperation) []byte {
+	data, _ := json.Marshal(op)
+	return data
+}
+
+func DecodeKVOperation(data []byte) (*KVOperation, error) {
+	op := &KVOperation{}
+	err := json.Unmarshal(data, op)
+	if err != nil {
+		return nil, err
+	}
+	if op.Type < KVGet || op.Type > KVScan {
+		return nil, errors.New("invalid kv operation type")
+	}
+	return op, nil
+}
+
+func DecodeKVResult(data []byte) (*KVResult, error) {
+	result := &KVResult{}
+	err := json.Unmarshal(data, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// KVStore is a replicated key-value store. Its snapshot is the JSON
+// encoding of the data, which orders keys, so equal states have equal
+// snapshots and digests.
+type KVStore struct {
+	data map[string]string
+}
+
+func NewKVStore() *KVStore {
+	kv := &KVStore{}
+	kv.data = make(map[string]string)
+	return kv
+}
+
+func (kv *KVStore) Apply(operation []byte) []byte {
+	result := &KVResult{}
+	op, err := DecodeKVOperation(operation)
+	if err != nil {
+		result.Err = "Invalid operation"
+	} else {
+		kv.apply(op, result)
+	}
+
+	data, _ := json.Marshal(result)
+	return data
+}
+
+// Query executes get and scan operations without changing the store.
+func (kv *KVStore) Query(operation []byte) ([]byte, error) {
+	op, err := DecodeKVOperation(operation)
+	if err != nil {
+		return nil, err
+	}
+	if op.Type != KVGet && op.Type != KVScan {
+		return nil, errors.New("not a read-only operation")
+	}
+
+	result := &KVResult{}
+	kv.apply(op, result)
+	return json.Marshal(result)
+}
+
+func (kv *KVStore) apply(op *KVOperation, result *KVResult) {
+	switch op.Type {
+	case KVGet:
+		result.Value, result.Ok = kv.data[op.Key]
+	case KVPut:
+		kv.data[op.Key] = op.Value
+		result.Ok = true
+	case KVDelete:
+		_, result.Ok = kv.data[op.Key]
+		delete(kv.data, op.Key)
+	case KVCompareAndSwap:
+		value, ok := kv.data[op.Key]
+		if (ok && value == op.Expected) || (!ok && op.Expected == "") {
+			kv.data[op.Key] = op.Value
+			result.Ok = true
+		}
+		result.Value = value
+	case KVScan:
+		keys := make([]string, 0)
+		for key := range kv.data {
+			if key >= op.Key && (op.EndKey == "" || key < op.EndKey) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		result.Pairs = make([]KVPair, len(keys))
+		for i, key := range keys {
+			result.Pairs[i] = KVPair{key, kv.data[key]}
+		}
+		result.Ok = true
+	}
+}
+
+func (kv *KVStore) Snapshot() ([]byte, error) {
+	return json.Marshal(kv.data)
+}
+
+func (kv *KVStore) Restore(snapshot []byte) error {
+	data := make(map[string]string)
+	err := json.Unmarshal(snapshot, &data)
+	if err != nil {
+		return err
+	}
+	kv.data = data
+	return nil
+}
+
+// Digest returns the hex encoded SHA-256 of the snapshot of the store.
+func (kv *KVStore) Digest() string {
+	snapshot, _ := kv.Snapshot()
+	return snapshotDigest(snapshot)
+}
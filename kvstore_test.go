@@ -0,0 +1,173 @@
+package pbft
+
+import (
+	"bytes"
+	"testing"
+)
+
+func kvApply(t *testing.T, kv *KVStore, op *KVOperation) *KVResult {
+	result, err := DecodeKVResult(kv.Apply(EncodeKVOperation(op)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func kvOp(opType KVOpType, key string, value string) *KVOperation {
+	op := &KVOperation{}
+	op.Type = opType
+	op.Key = key
+	op.Value = value
+	return op
+}
+
+// TestKVStoreApply runs every operation type, deletes and compare-and-swaps
+// on missing keys included.
+func TestKVStoreApply(t *testing.T) {
+	kv := NewKVStore()
+	if result := kvApply(t, kv, kvOp(KVGet, "a", "")); result.Ok {
+		t.Error("get of a missing key succeeded")
+	}
+	if result := kvApply(t, kv, kvOp(KVPut, "a", "1")); !result.Ok {
+		t.Error("put failed")
+	}
+	if result := kvApply(t, kv, kvOp(KVGet, "a", "")); !result.Ok || result.Value != "1" {
+		t.Errorf("get returned %q, expected 1", result.Value)
+	}
+
+	if result := kvApply(t, kv, kvOp(KVDelete, "b", "")); result.Ok {
+		t.Error("delete of a missing key succeeded")
+	}
+	if result := kvApply(t, kv, kvOp(KVDelete, "a", "")); !result.Ok {
+		t.Error("delete failed")
+	}
+	if result := kvApply(t, kv, kvOp(KVGet, "a", "")); result.Ok {
+		t.Error("deleted key found")
+	}
+
+	cas := kvOp(KVCompareAndSwap, "c", "1")
+	cas.Expected = "0"
+	if result := kvApply(t, kv, cas); result.Ok {
+		t.Error("compare-and-swap on a missing key matched a value")
+	}
+	cas.Expected = ""
+	if result := kvApply(t, kv, cas); !result.Ok {
+		t.Error("compare-and-swap on a missing key did not match the empty value")
+	}
+	cas.Value = "2"
+	if result := kvApply(t, kv, cas); result.Ok || result.Value != "1" {
+		t.Errorf("compare-and-swap with a stale value succeeded or returned %q", result.Value)
+	}
+	cas.Expected = "1"
+	if result := kvApply(t, kv, cas); !result.Ok {
+		t.Error("compare-and-swap with the current value failed")
+	}
+	if result := kvApply(t, kv, kvOp(KVGet, "c", "")); result.Value != "2" {
+		t.Errorf("compare-and-swap left %q, expected 2", result.Value)
+	}
+
+	if result, _ := DecodeKVResult(kv.Apply([]byte("garbage"))); result == nil || result.Err == "" {
+		t.Error("invalid operation applied")
+	}
+}
+
+// TestKVStoreScan scans bounded and open ranges. The start key is
+// included, the end key is not.
+func TestKVStoreScan(t *testing.T) {
+	kv := NewKVStore()
+	for _, key := range []string{"d", "b", "a", "c"} {
+		kvApply(t, kv, kvOp(KVPut, key, key))
+	}
+
+	scan := func(key string, endKey string) string {
+		op := kvOp(KVScan, key, "")
+		op.EndKey = endKey
+		result := kvApply(t, kv, op)
+		keys := ""
+		for _, pair := range result.Pairs {
+			keys += pair.Key
+		}
+		return keys
+	}
+	if keys := scan("b", "d"); keys != "bc" {
+		t.Errorf("scan from b to d returned %q", keys)
+	}
+	if keys := scan("b", ""); keys != "bcd" {
+		t.Errorf("scan from b to the end returned %q", keys)
+	}
+	if keys := scan("e", ""); keys != "" {
+		t.Errorf("scan beyond the last key returned %q", keys)
+	}
+}
+
+// TestKVStoreQuery executes reads without ordering them. Writes are
+// rejected and leave the store unchanged.
+func TestKVStoreQuery(t *testing.T) {
+	kv := NewKVStore()
+	kvApply(t, kv, kvOp(KVPut, "a", "1"))
+	digest := kv.Digest()
+
+	data, err := kv.Query(EncodeKVOperation(kvOp(KVGet, "a", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := DecodeKVResult(data)
+	if err != nil || !result.Ok || result.Value != "1" {
+		t.Errorf("query returned %v: %v", result, err)
+	}
+	data, err = kv.Query(EncodeKVOperation(kvOp(KVScan, "", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = DecodeKVResult(data)
+	if err != nil || len(result.Pairs) != 1 {
+		t.Errorf("scan query returned %v: %v", result, err)
+	}
+
+	for _, opType := range []KVOpType{KVPut, KVDelete, KVCompareAndSwap} {
+		_, err := kv.Query(EncodeKVOperation(kvOp(opType, "a", "2")))
+		if err == nil {
+			t.Errorf("write of type %d executed as a query", opType)
+		}
+	}
+	if kv.Digest() != digest {
+		t.Error("queries changed the store")
+	}
+}
+
+// TestKVStoreSnapshot applies the same writes in different orders. The
+// snapshots and digests must be equal, and a restored store must have the
+// same state.
+func TestKVStoreSnapshot(t *testing.T) {
+	first := NewKVStore()
+	second := NewKVStore()
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i := range keys {
+		kvApply(t, first, kvOp(KVPut, keys[i], keys[i]))
+		kvApply(t, second, kvOp(KVPut, keys[len(keys)-1-i], keys[len(keys)-1-i]))
+	}
+
+	firstSnapshot, err := first.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondSnapshot, err := second.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstSnapshot, secondSnapshot) || first.Digest() != second.Digest() {
+		t.Error("equal stores have different snapshots")
+	}
+
+	restored := NewKVStore()
+	err = restored.Restore(firstSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Digest() != first.Digest() {
+		t.Error("restored store differs from the snapshot")
+	}
+	if result := kvApply(t, restored, kvOp(KVGet, "c", "")); result.Value != "c" {
+		t.Errorf("restored store returned %q for c", result.Value)
+	}
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 
@@ -12,17 +20,230 @@ import (
 )
 
 type NodeInfo struct {
-	Id      int    `json:"id"`
-	Address string `json:"address"`
-	Debug   string `json:"debug"`
+	Id           int    `json:"id"`
+	Address      string `json:"address"`
+	Debug        string `json:"debug"`
+	PublicKey    string `json:"publicKey"`
+	MacPublicKey string `json:"macPublicKey"`
+}
+
+// NodeKeys is the content of the key file of a node. Only the node itself
+// reads it, the config file shared by all nodes holds the public keys.
+type NodeKeys struct {
+	PrivateKey    string `json:"privateKey"`
+	MacPrivateKey string `json:"macPrivateKey"`
 }
 
 type X struct {
-	Servers []NodeInfo `json:"servers"`
-	Clients []NodeInfo `json:"clients"`
+	// "signature" (default) or "mac"
+	AuthMode string `json:"authMode"`
+	// sequence ids between checkpoints and between the low and the high
+	// watermark, 0 selects the default
+	CheckpointInterval int `json:"checkpointInterval"`
+	LogWindow          int `json:"logWindow"`
+	// milliseconds between two proactive recoveries of a server, 0
+	// disables them, only the MAC session keys are refreshed, so they
+	// need the "mac" auth mode
+	RecoveryInterval int `json:"recoveryInterval"`
+	// every server keeps its write-ahead log in a subdirectory of walDir,
+	// empty disables it
+	WalDir string `json:"walDir"`
+	// "always" (default), "interval" or "never"
+	SyncPolicy   string `json:"syncPolicy"`
+	SyncInterval int    `json:"syncInterval"`
+	// snapshots of stable checkpoints kept on disk, 0 selects the default
+	SnapshotRetention int        `json:"snapshotRetention"`
+	Servers           []NodeInfo `json:"servers"`
+	Clients           []NodeInfo `json:"clients"`
+}
+
+const configFile = "config.json"
+const keyDir = "keys"
+
+// keyFile returns the path of the private key file of a node.
+func keyFile(nodeType string, id int) string {
+	return filepath.Join(keyDir, nodeType+"-"+strconv.Itoa(id)+".key")
+}
+
+// generateKeys creates a fresh Ed25519 signing key pair and X25519 MAC key
+// pair for every node in the config file. The private keys are written to
+// a key file per node, only the public keys are written back to the config
+// file.
+func generateKeys() error {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	var x X
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(keyDir, 0700)
+	if err != nil {
+		return err
+	}
+	nodes := map[string][]NodeInfo{"server": x.Servers, "client": x.Clients}
+	for nodeType, list := range nodes {
+		for i := range list {
+			pub, priv, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			macPriv, err := ecdh.X25519().GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+
+			nodeKeys := &NodeKeys{}
+			nodeKeys.PrivateKey = hex.EncodeToString(priv.Seed())
+			nodeKeys.MacPrivateKey = hex.EncodeToString(macPriv.Bytes())
+			data, err := json.MarshalIndent(nodeKeys, "", "    ")
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(keyFile(nodeType, list[i].Id), data, 0600)
+			if err != nil {
+				return err
+			}
+
+			list[i].PublicKey = hex.EncodeToString(pub)
+			list[i].MacPublicKey = hex.EncodeToString(macPriv.PublicKey().Bytes())
+		}
+	}
+
+	data, err = json.MarshalIndent(&x, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile, data, 0600)
+}
+
+func parsePublicKeys(nodes []NodeInfo) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, len(nodes))
+	for _, node := range nodes {
+		key, err := hex.DecodeString(node.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid public key of node " + strconv.Itoa(node.Id))
+		}
+		keys[node.Id] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
+
+func parseMacPublicKeys(nodes []NodeInfo) ([]*ecdh.PublicKey, error) {
+	keys := make([]*ecdh.PublicKey, len(nodes))
+	for _, node := range nodes {
+		data, err := hex.DecodeString(node.MacPublicKey)
+		if err != nil {
+			return nil, errors.New("invalid mac public key of node " + strconv.Itoa(node.Id))
+		}
+		keys[node.Id], err = ecdh.X25519().NewPublicKey(data)
+		if err != nil {
+			return nil, errors.New("invalid mac public key of node " + strconv.Itoa(node.Id))
+		}
+	}
+	return keys, nil
+}
+
+func loadMacKeys(x *X, nodeKeys *NodeKeys, keys *pbft.KeyConfig) error {
+	data, err := hex.DecodeString(nodeKeys.MacPrivateKey)
+	if err != nil {
+		return errors.New("invalid mac private key")
+	}
+	keys.MacKey, err = ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return errors.New("invalid mac private key")
+	}
+	keys.ServerMacKeys, err = parseMacPublicKeys(x.Servers)
+	if err != nil {
+		return err
+	}
+	keys.ClientMacKeys, err = parseMacPublicKeys(x.Clients)
+	return err
+}
+
+// loadKeys reads the private keys of a node from its key file and the
+// public keys of every node from the config file.
+func loadKeys(x *X, nodeType string, id int) (*pbft.KeyConfig, error) {
+	data, err := ioutil.ReadFile(keyFile(nodeType, id))
+	if err != nil {
+		return nil, err
+	}
+	nodeKeys := &NodeKeys{}
+	err = json.Unmarshal(data, nodeKeys)
+	if err != nil {
+		return nil, errors.New("invalid key file")
+	}
+
+	seed, err := hex.DecodeString(nodeKeys.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid private key")
+	}
+
+	keys := &pbft.KeyConfig{}
+	keys.PrivateKey = ed25519.NewKeyFromSeed(seed)
+	keys.ServerKeys, err = parsePublicKeys(x.Servers)
+	if err != nil {
+		return nil, err
+	}
+	keys.ClientKeys, err = parsePublicKeys(x.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x.AuthMode {
+	case "", "signature":
+		keys.AuthMode = pbft.SignatureAuthMode
+	case "mac":
+		keys.AuthMode = pbft.MacAuthMode
+		err = loadMacKeys(x, nodeKeys, keys)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid auth mode " + x.AuthMode)
+	}
+	return keys, nil
+}
+
+// openStorage opens the file storage of a server in its subdirectory of
+// walDir. Without walDir the server keeps nothing across restarts.
+func openStorage(x *X, id int) (pbft.Storage, error) {
+	if x.WalDir == "" {
+		return nil, nil
+	}
+
+	var policy pbft.SyncPolicy
+	switch x.SyncPolicy {
+	case "", "always":
+		policy = pbft.SyncAlways
+	case "interval":
+		policy = pbft.SyncInterval
+	case "never":
+		policy = pbft.SyncNever
+	default:
+		return nil, errors.New("invalid sync policy " + x.SyncPolicy)
+	}
+	dir := filepath.Join(x.WalDir, "server-"+strconv.Itoa(id))
+	storage, err := pbft.NewFileStorage(dir, policy, x.SyncInterval, x.SnapshotRetention)
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
 }
 
 func main() {
+	if len(os.Args) == 2 && os.Args[1] == "keygen" {
+		err := generateKeys()
+		if err != nil {
+			log.Fatal("keygen error: ", err)
+		}
+		return
+	}
+
 	if len(os.Args) < 3 {
 		log.Fatal("Invalid augments")
 		return
@@ -39,7 +260,7 @@ func main() {
 		log.Fatal("Invalid id")
 		return
 	}
-	viper.SetConfigName("config.json")
+	viper.SetConfigName(configFile)
 	viper.AddConfigPath(".")
 	viper.SetConfigType("json")
 	err = viper.ReadInConfig()
@@ -61,14 +282,30 @@ func main() {
 
 	if nodeType == "server" {
 		debugAddr := x.Servers[id].Debug
+		keys, err := loadKeys(&x, "server", id)
+		if err != nil {
+			log.Fatal("key error: ", err)
+		}
+		config := &pbft.Config{}
+		config.CheckpointInterval = x.CheckpointInterval
+		config.LogWindow = x.LogWindow
+		config.RecoveryInterval = x.RecoveryInterval
+		storage, err := openStorage(&x, id)
+		if err != nil {
+			log.Fatal("storage error: ", err)
+		}
 		wg := &sync.WaitGroup{}
-		pbft.RunPbftServer(id, serverAddrs, clientAddrs, true, debugAddr, wg)
+		pbft.RunPbftServer(id, serverAddrs, clientAddrs, keys, config, pbft.NewKVStore(), storage, true, debugAddr, wg)
 		wg.Wait()
 	} else if nodeType == "client" {
 		clientAddr := x.Clients[id].Address
 		debugAddr := x.Clients[id].Debug
+		keys, err := loadKeys(&x, "client", id)
+		if err != nil {
+			log.Fatal("key error: ", err)
+		}
 		wg := &sync.WaitGroup{}
-		pbft.RunClient(id, clientAddr, serverAddrs, true, debugAddr, wg)
+		pbft.RunClient(id, clientAddr, serverAddrs, keys, true, debugAddr, wg)
 		wg.Wait()
 	}
 
@@ -11,4 +11,6 @@ elif [ $1 = "kill" ]; then
     pgrep -f pbft-client | xargs kill
 elif [ $1 = "build" ]; then
     go build
+elif [ $1 = "keygen" ]; then
+    ./main keygen
 fi
\ No newline at end of file
@@ -52,19 +52,19 @@ func (pf *Pbft) maliciousBroadcast(rpcname string, rpcargs interface{}, isPartia
 	case "NewView":
 		fakeArgs = pf.maliciousNewView(rpcargs.(*NewViewArgs))
 	}
+	pf.seal(fakeArgs)
 
 	maliciousCnt := pf.n
 	if isPartial {
 		maliciousCnt = pf.maliciousPartialVal
 	}
-	reply := &DefaultReply{}
 	// todo: random range
 	for _, peer := range pf.servers {
 		p := peer
 		if maliciousCnt > 0 {
-			go p.Call("Pbft."+rpcname, fakeArgs, reply)
+			go p.Call("Pbft."+rpcname, fakeArgs, &DefaultReply{})
 		} else {
-			go p.Call("Pbft."+rpcname, realArgs, reply)
+			go p.Call("Pbft."+rpcname, realArgs, &DefaultReply{})
 		}
 		maliciousCnt--
 	}
@@ -75,10 +75,12 @@ func (pf *Pbft) maliciousPreprepare(args *PrePrepareAgrs) *PrePrepareAgrs {
 	newArgs := &PrePrepareAgrs{}
 	newArgs.ViewId = args.ViewId
 	newArgs.SeqId = args.SeqId
-	// todo: generate fake digest
-	newArgs.Digest = "fake cmd"
-	newArgs.Request = args.Request
-	newArgs.Request.Operation = "fake cmd"
+	newArgs.Requests = make([]RequestArgs, len(args.Requests))
+	copy(newArgs.Requests, args.Requests)
+	for i := range newArgs.Requests {
+		newArgs.Requests[i].Operation = []byte("fake cmd")
+	}
+	newArgs.Digest = batchDigest(newArgs.Requests)
 	return newArgs
 }
 
@@ -117,15 +119,17 @@ func (pf *Pbft) maliciousViewChange(args *ViewChangeArgs) *ViewChangeArgs {
 	newArgs.ViewId = args.ViewId + 1
 	newArgs.LastCheckpointSeqId = args.LastCheckpointSeqId
 	newArgs.LastCheckpointDigest = args.LastCheckpointDigest
+	newArgs.LastCheckpointProof = args.LastCheckpointProof
 	newArgs.PreparedRequestSet = make(map[int]PreparedRequest)
 	return newArgs
 }
 
 func (pf *Pbft) maliciousNewView(args *NewViewArgs) *NewViewArgs {
 	newArgs := &NewViewArgs{}
-	newArgs.ViewId = args.ViewId + 1
-	newArgs.NewPreprepares = args.NewPreprepares
-	newArgs.PreparedRequestSet = args.PreparedRequestSet
+	newArgs.ViewId = args.ViewId
+	newArgs.ViewChanges = args.ViewChanges
+	// drop the requests carried over from the previous views
+	newArgs.NewPreprepares = make(map[int]PrePrepareAgrs)
 	return newArgs
 }
 
@@ -134,6 +138,6 @@ func (pf *Pbft) maliciousReply(args *ReplyArgs) *ReplyArgs {
 	newArgs.ReplicaId = pf.me
 	newArgs.ViewId = args.ViewId
 	newArgs.Timestamp = args.Timestamp
-	newArgs.Result = "fake Result"
+	newArgs.Result = []byte("fake Result")
 	return newArgs
 }
@@ -1,7 +1,6 @@
 package pbft
 
 import (
-	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -10,31 +9,72 @@ import (
 )
 
 type peerWrapper struct {
+	mu      *sync.Mutex
 	client  *rpc.Client
 	address string
+	closed  bool
 }
 
-func (c *peerWrapper) Call(serviceMethod string, args interface{}, reply interface{}) error {
-	var err error
-	if c.client == nil {
-		err = errors.New("")
-	} else {
-		err = c.client.Call(serviceMethod, args, reply)
+// getClient returns the connection to the peer, dialing it if needed.
+// A failed connection is replaced when reset is set.
+func (c *peerWrapper) getClient(reset *rpc.Client) (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if c.client != nil && c.client != reset {
+		return c.client, nil
+	}
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
 	}
+
+	client, err := rpc.DialHTTP("tcp", c.address)
 	if err != nil {
-		var errdial error
-		c.client, errdial = rpc.DialHTTP("tcp", c.address)
-		if errdial != nil {
-			return errdial
+		return nil, err
+	}
+	c.client = client
+	return client, nil
+}
+
+func (c *peerWrapper) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	client, err := c.getClient(nil)
+	if err == nil {
+		err = client.Call(serviceMethod, args, reply)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			return err
 		}
-		err = c.client.Call(serviceMethod, args, reply)
 	}
-	return err
+
+	client, err = c.getClient(client)
+	if err != nil {
+		return err
+	}
+	return client.Call(serviceMethod, args, reply)
+}
+
+// close drops the connection to the peer and fails every later call, the
+// way the network of a crashed process does.
+func (c *peerWrapper) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
 }
 
-func createPeers(addresses []string) []peerWrapper {
-	peers := make([]peerWrapper, len(addresses))
+func createPeers(addresses []string) []*peerWrapper {
+	peers := make([]*peerWrapper, len(addresses))
 	for i := 0; i < len(addresses); i++ {
+		peers[i] = &peerWrapper{}
+		peers[i].mu = &sync.Mutex{}
 		peers[i].client = nil
 		peers[i].address = addresses[i]
 	}
@@ -42,16 +82,28 @@ func createPeers(addresses []string) []peerWrapper {
 	return peers
 }
 
-func RunPbftServer(id int, serverAddrs, clientAddrs []string, debug bool, debugAddr string, wg *sync.WaitGroup) *Pbft {
+func RunPbftServer(id int, serverAddrs, clientAddrs []string, keys *KeyConfig, config *Config, sm StateMachine, storage Storage, debug bool, debugAddr string, wg *sync.WaitGroup) *Pbft {
 	debugCh := make(chan interface{}, 1024)
 	servers := createPeers(serverAddrs)
 	clients := createPeers(clientAddrs)
-	pbft := MakePbft(id, servers, clients, debugCh)
+	pbft, err := MakePbft(id, servers, clients, keys, config, sm, storage, debugCh)
+	if err != nil {
+		log.Fatal("config error:", err)
+		return nil
+	}
 
 	if debug {
 		MakePbftDebugServer(debugAddr, debugCh, pbft, wg)
 	}
 
+	if storage != nil {
+		err = pbft.restore()
+		if err != nil {
+			log.Fatal("storage error:", err)
+			return nil
+		}
+	}
+
 	rpc.Register(pbft)
 	rpc.HandleHTTP()
 	l, err := net.Listen("tcp", serverAddrs[id])
@@ -61,13 +113,16 @@ func RunPbftServer(id int, serverAddrs, clientAddrs []string, debug bool, debugA
 	}
 
 	go http.Serve(l, nil)
+	if config.RecoveryInterval > 0 {
+		go pbft.recoveryLoop()
+	}
 	return pbft
 }
 
-func RunClient(id int, clientAddr string, pbftAddrs []string, debug bool, debugAddr string, wg *sync.WaitGroup) *Client {
+func RunClient(id int, clientAddr string, pbftAddrs []string, keys *KeyConfig, debug bool, debugAddr string, wg *sync.WaitGroup) *Client {
 	debugCh := make(chan interface{}, 1024)
 	peers := createPeers(pbftAddrs)
-	client := MakeClient(id, peers, debugCh)
+	client := MakeClient(id, peers, keys, debugCh)
 
 	if debug {
 		MakeClientDebugServer(debugAddr, debugCh, client, wg)
@@ -1,33 +1,75 @@
 package pbft
 
 import (
+	"crypto/ed25519"
 	"fmt"
-	"strconv"
 	"sync"
 	"time"
 )
 
-const CheckPointSequenceInterval = 10
 const RequestTimeout = 5000
+const ViewChangeTimeout = 5000
+const GapTimeout = 2000
+const BatchSize = 16
+const BatchTimeout = 20
 
 type Pbft struct {
 	mu                   *sync.Mutex
-	servers              []peerWrapper
-	clients              []peerWrapper
+	servers              []*peerWrapper
+	clients              []*peerWrapper
 	n                    int
 	f                    int
 	me                   int
 	viewId               int
 	seqId                int
-	requestTimer         map[int64]*TimerWithCancel
+	requestTimer         map[requestKey]*TimerWithCancel
 	logs                 map[int]*LogEntry
-	prepares             map[int]map[int]string
-	commits              map[int]map[int]string
-	checkpoints          map[int]map[int]string
-	viewChanges          map[int]map[int]PreparedRequest
+	prepares             map[int]map[int]*PrepareArgs
+	commits              map[int]map[int]*CommitArgs
+	checkpoints          map[int]map[int]*CheckpointArgs
+	viewChanges          map[int]map[int]*ViewChangeArgs
+	viewChanging         bool
+	newView              *NewViewArgs
+	nextViewId           int
+	viewChangeTimer      *TimerWithCancel
+	viewChangeTimeout    int
 	maxCommitted         int
+	lastExecuted         int
+	tentative            *LogEntry
+	readOnlyRequests     []RequestArgs
+	gapTimer             *TimerWithCancel
+	lastReplies          map[int]*ReplyArgs
+	pendingRequests      []RequestArgs
+	batchTimer           *TimerWithCancel
+	futurePreprepares    map[int]map[int]*PrePrepareAgrs
+	futureCheckpoints    map[int]*CheckpointArgs
+	lastCheckpointProof  []CheckpointArgs
+	sm                   StateMachine
+	snapshots            map[int][]byte
+	divergedSeqId        int
+	fetching             bool
 	lastCheckpointSeqId  int
 	lastCheckpointDigest string
+	checkpointInterval   int
+	logWindow            int
+	storage              Storage
+
+	// proactive recovery
+	initialSnapshot  []byte
+	recoveryInterval int
+	recoverySeqId    int
+	newKey           *NewKeyArgs
+
+	// window occupancy metrics
+	windowPeak       int
+	heldBackRequests int
+
+	// keys
+	privateKey ed25519.PrivateKey
+	serverKeys []ed25519.PublicKey
+	clientKeys []ed25519.PublicKey
+	authMode   AuthMode
+	auth       authenticator
 
 	// debug
 	debugCh chan interface{}
@@ -37,21 +79,74 @@ type Pbft struct {
 	maliciousModes map[string]MaliciousBehaviorMode
 	// define how many malicious msgs in PartiallyMaliciousMode
 	maliciousPartialVal int
+
+	// fault injection
+	crashPoint string
+	onCrash    func()
 }
 
 func (pf *Pbft) isPrimary() bool {
 	return pf.me == pf.viewId%pf.n
 }
 
+func (pf *Pbft) sign(msg signedMessage) {
+	signMessage(pf.privateKey, msg)
+}
+
+func (pf *Pbft) verifyReplica(replicaId int, msg signedMessage) bool {
+	if replicaId < 0 || replicaId >= len(pf.serverKeys) {
+		return false
+	}
+	return verifyMessage(pf.serverKeys[replicaId], msg)
+}
+
+// authReplica checks a normal-case message from a replica with the
+// configured authenticator.
+func (pf *Pbft) authReplica(replicaId int, msg authenticatedMessage) bool {
+	if replicaId < 0 || replicaId >= len(pf.servers) {
+		return false
+	}
+	if !pf.auth.verifyReplica(replicaId, msg) {
+		pf.sendNewKey(pf.servers[replicaId], "Pbft.NewKey")
+		return false
+	}
+	return true
+}
+
+func (pf *Pbft) authClient(clientId int, msg authenticatedMessage) bool {
+	if clientId < 0 || clientId >= len(pf.clients) {
+		return false
+	}
+	if !pf.auth.verifyClient(clientId, msg) {
+		pf.sendNewKey(pf.clients[clientId], "Client.NewKey")
+		return false
+	}
+	return true
+}
+
+// seal authenticates normal-case messages with the configured
+// authenticator and signs all other messages. In signature mode a message
+// signed before it was logged is not signed again.
+func (pf *Pbft) seal(rpcargs interface{}) {
+	if msg, ok := rpcargs.(authenticatedMessage); ok {
+		if pf.authMode == SignatureAuthMode && msg.signature() != nil {
+			return
+		}
+		pf.auth.authenticate(msg)
+	} else if msg, ok := rpcargs.(signedMessage); ok {
+		pf.sign(msg)
+	}
+}
+
 func (pf *Pbft) broadcast(rpcname string, rpcargs interface{}) {
 	pf.debugPrint("Broadcast: " + rpcname + "\n")
+	pf.seal(rpcargs)
 	maliciousMode := pf.maliciousModes[rpcname]
 	switch maliciousMode {
 	case NormalMode:
-		reply := &DefaultReply{}
 		for _, peer := range pf.servers {
 			p := peer
-			go p.Call("Pbft."+rpcname, rpcargs, reply)
+			go p.Call("Pbft."+rpcname, rpcargs, &DefaultReply{})
 		}
 	case CrashedLikeMode:
 		return
@@ -66,6 +161,7 @@ func (pf *Pbft) replyClient(clientId int, replyArgs *ReplyArgs) {
 	pf.debugPrint(fmt.Sprintf("Reply to client[%d]\n", clientId))
 	client := pf.clients[clientId]
 	defaultReply := &DefaultReply{}
+	pf.sign(replyArgs)
 	switch pf.maliciousModes["Reply"] {
 	case NormalMode:
 		go client.Call("Client.Reply", replyArgs, defaultReply)
@@ -76,90 +172,454 @@ func (pf *Pbft) replyClient(clientId int, replyArgs *ReplyArgs) {
 		return
 	case MaliciousMode:
 		fakeArgs := pf.maliciousReply(replyArgs)
+		pf.sign(fakeArgs)
 		go client.Call("Client.Reply", fakeArgs, defaultReply)
 	}
 }
 
-func (pf *Pbft) newRequestTimer(timestamp int64) {
-	if pf.requestTimer[timestamp] != nil {
-		pf.requestTimer[timestamp].Cancel()
-		delete(pf.requestTimer, timestamp)
+// highWatermark is the highest sequence id accepted before the next
+// checkpoint becomes stable.
+func (pf *Pbft) highWatermark() int {
+	return pf.lastCheckpointSeqId + pf.logWindow
+}
+
+// windowUsed returns the number of sequence ids in the log window that
+// are assigned to an entry.
+func (pf *Pbft) windowUsed() int {
+	used := 0
+	for seqId := range pf.logs {
+		if seqId > pf.lastCheckpointSeqId {
+			used++
+		}
 	}
-	newTimer := NewTimerWithCancel(time.Duration(RequestTimeout * time.Millisecond))
-	newTimer.SetTimeout(func() {
-		pf.debugPrint(fmt.Sprintf("Request timeout: Timestamp[%d]\n", timestamp))
-		delete(pf.requestTimer, timestamp)
-		// todo: timer for viewchange
-		pf.sendViewChange()
+	return used
+}
+
+// propose assigns the next sequence id to a batch of requests and
+// multicasts its pre-prepare. Only called on the primary.
+func (pf *Pbft) propose(requests []RequestArgs) {
+	// insert requset to log
+	pf.seqId++
+
+	prepreareArgs := &PrePrepareAgrs{}
+	prepreareArgs.ViewId = pf.viewId
+	prepreareArgs.SeqId = pf.seqId
+	prepreareArgs.Requests = requests
+	prepreareArgs.Digest = batchDigest(requests)
+	// the sequence id is logged with the signed pre-prepare before it is
+	// sent, a restarted primary never assigns it again
+	pf.sign(prepreareArgs)
+	pf.persistPreprepare(prepreareArgs)
+	pf.crashAt(CrashPreprepare)
+	pf.broadcast("Preprepare", prepreareArgs)
+
+	newLog := &LogEntry{}
+	newLog.SeqId = prepreareArgs.SeqId
+	newLog.Digest = prepreareArgs.Digest
+	newLog.Requests = prepreareArgs.Requests
+	newLog.Signature = prepreareArgs.Signature
+	newLog.ViewId = pf.viewId
+	newLog.Phase = PbftPhasePrepare
+	pf.logs[prepreareArgs.SeqId] = newLog
+}
+
+// proposePending proposes the pending requests in batches of up to
+// BatchSize while the log window has room. A partial batch is only
+// proposed on flush, which happens at the latest BatchTimeout after it
+// started waiting.
+func (pf *Pbft) proposePending(flush bool) {
+	if pf.viewChanging {
+		return
+	}
+	for len(pf.pendingRequests) > 0 && pf.seqId < pf.highWatermark() {
+		size := len(pf.pendingRequests)
+		if size > BatchSize {
+			size = BatchSize
+		} else if size < BatchSize && !flush {
+			break
+		}
+		batch := pf.pendingRequests[:size:size]
+		pf.pendingRequests = pf.pendingRequests[size:]
+		pf.propose(batch)
+	}
+	pf.watchBatch()
+}
+
+// watchBatch starts the batch timer while a partial batch waits for more
+// requests and the log window has room for it.
+func (pf *Pbft) watchBatch() {
+	if len(pf.pendingRequests) == 0 || pf.seqId >= pf.highWatermark() {
+		if pf.batchTimer != nil {
+			pf.batchTimer.Cancel()
+			pf.batchTimer = nil
+		}
+		return
+	}
+
+	if pf.batchTimer != nil {
+		return
+	}
+
+	timer := NewTimerWithCancel(time.Duration(BatchTimeout * time.Millisecond))
+	timer.SetTimeout(func() {
+		pf.mu.Lock()
+		defer pf.mu.Unlock()
+		if pf.batchTimer != timer {
+			return
+		}
+		pf.batchTimer = nil
+		if pf.isPrimary() {
+			pf.proposePending(true)
+		}
 	})
-	newTimer.Start()
-	pf.requestTimer[timestamp] = newTimer
+	timer.Start()
+	pf.batchTimer = timer
 }
 
-func (pf *Pbft) sendViewChange() {
-	pf.mu.Lock()
-	defer pf.mu.Unlock()
+// acceptPreprepare logs a valid pre-prepare and multicasts the matching
+// prepare.
+func (pf *Pbft) acceptPreprepare(args *PrePrepareAgrs) {
+	newLog := pf.logs[args.SeqId]
+	if !pf.isPrimary() || newLog == nil {
+		newLog = &LogEntry{}
+		newLog.SeqId = args.SeqId
+		newLog.Digest = args.Digest
+		newLog.Requests = args.Requests
+		newLog.Signature = args.Signature
+		newLog.ViewId = pf.viewId
+		newLog.Phase = PbftPhasePrepare
+		pf.logs[args.SeqId] = newLog
+		pf.persistPreprepare(args)
+	}
 
-	// find all prepared but not committed request
-	preparedRequestSet := make(map[int]PreparedRequest)
-	for seqId, prepares := range pf.prepares {
-		log, ok := pf.logs[seqId]
-		if !ok {
+	if used := args.SeqId - pf.lastCheckpointSeqId; used > pf.windowPeak {
+		pf.windowPeak = used
+	}
+
+	// broadcast Prepare
+	prepareArgs := &PrepareArgs{}
+	prepareArgs.SeqId = newLog.SeqId
+	prepareArgs.ReplicaId = pf.me
+	prepareArgs.ViewId = pf.viewId
+	prepareArgs.Digest = args.Digest
+	// in signature mode the prepare is signed before it is logged. In MAC
+	// mode the backups sign it as well, it proves the entry prepared in
+	// view-change messages, the prepare of the primary is never part of a
+	// certificate and only carries MACs
+	if pf.authMode == SignatureAuthMode || !pf.isPrimary() {
+		pf.sign(prepareArgs)
+	}
+	pf.savePrepare(prepareArgs)
+	pf.crashAt(CrashPrepare)
+	pf.broadcast("Prepare", prepareArgs)
+	pf.processPrepares(args.SeqId)
+}
+
+// saveFuturePreprepare buffers a pre-prepare of the current view above the
+// high watermark or one of the view the replica is moving to. The buffer is
+// keyed by view and sequence id, so a pre-prepare of the next view never
+// replaces one of the current view, and the first one of a view is kept.
+// The views the replica left or gave up are dropped. It reports false for a
+// pre-prepare that conflicts with the buffered one.
+func (pf *Pbft) saveFuturePreprepare(args *PrePrepareAgrs) bool {
+	for viewId := range pf.futurePreprepares {
+		if viewId != pf.viewId && viewId != pf.nextViewId {
+			delete(pf.futurePreprepares, viewId)
+		}
+	}
+
+	if pf.futurePreprepares[args.ViewId] == nil {
+		pf.futurePreprepares[args.ViewId] = make(map[int]*PrePrepareAgrs)
+	}
+	if preprepare, ok := pf.futurePreprepares[args.ViewId][args.SeqId]; ok {
+		return preprepare.Digest == args.Digest
+	}
+	pf.futurePreprepares[args.ViewId][args.SeqId] = args
+	return true
+}
+
+// acceptFuturePreprepares accepts buffered pre-prepares once they fall
+// into the log window after a checkpoint became stable, or once the
+// replica entered their view.
+func (pf *Pbft) acceptFuturePreprepares() {
+	if pf.viewChanging {
+		return
+	}
+
+	for viewId, preprepares := range pf.futurePreprepares {
+		if viewId < pf.viewId {
+			delete(pf.futurePreprepares, viewId)
 			continue
 		}
-		if log.Phase != PbftPhasecommitted && len(prepares) > 2*pf.f {
-			digestCnt := make(map[string]int)
-			isDigestValid := false
-			for _, digest := range prepares {
-				digestCnt[digest]++
-				if digestCnt[digest] > 2*pf.f {
-					isDigestValid = true
-					break
-				}
+		if viewId > pf.viewId {
+			continue
+		}
+		for seqId, args := range preprepares {
+			if seqId <= pf.lastCheckpointSeqId {
+				delete(preprepares, seqId)
+				continue
 			}
-			if isDigestValid {
-				preparedRequest := PreparedRequest{}
-				preparedRequest.Request = *log
-				preparedRequest.Prepares = prepares
-				preparedRequestSet[seqId] = preparedRequest
+			if seqId <= pf.highWatermark() {
+				delete(preprepares, seqId)
+				pf.acceptPreprepare(args)
 			}
 		}
 	}
+}
+
+// requestKey identifies a request, the timestamps of different clients
+// may collide.
+type requestKey struct {
+	clientId  int
+	timestamp int64
+}
+
+func (pf *Pbft) newRequestTimer(key requestKey) {
+	if pf.requestTimer[key] != nil {
+		pf.requestTimer[key].Cancel()
+		delete(pf.requestTimer, key)
+	}
+	newTimer := NewTimerWithCancel(time.Duration(RequestTimeout * time.Millisecond))
+	newTimer.SetTimeout(func() {
+		pf.mu.Lock()
+		defer pf.mu.Unlock()
+		if pf.requestTimer[key] != newTimer {
+			return
+		}
+		pf.debugPrint(fmt.Sprintf("Request timeout: Client[%d] Timestamp[%d]\n", key.clientId, key.timestamp))
+		delete(pf.requestTimer, key)
+		if !pf.viewChanging {
+			pf.sendViewChange(pf.viewId + 1)
+		}
+	})
+	newTimer.Start()
+	pf.requestTimer[key] = newTimer
+}
+
+// sendViewChange moves the replica towards view newViewId. It stops
+// accepting normal-case messages and multicasts a view-change message.
+// If no valid new-view message arrives in time, it moves on to the next
+// view and doubles the timeout.
+func (pf *Pbft) sendViewChange(newViewId int) {
+	pf.debugPrint(fmt.Sprintf("Start view change to View[%d]\n", newViewId))
+	pf.viewChanging = true
+	pf.nextViewId = newViewId
+	pf.persistMetadata()
+	for key, timer := range pf.requestTimer {
+		timer.Cancel()
+		delete(pf.requestTimer, key)
+	}
+
+	// find all prepared request, committed ones included, they are
+	// assigned the same request in the new view
+	preparedRequestSet := make(map[int]PreparedRequest)
+	for seqId, log := range pf.logs {
+		if preparedRequest, ok := pf.preparedCertificate(log); ok {
+			preparedRequestSet[seqId] = preparedRequest
+		}
+	}
 
 	viewChangeArgs := &ViewChangeArgs{}
-	viewChangeArgs.ViewId = pf.viewId + 1
+	viewChangeArgs.ViewId = newViewId
 	viewChangeArgs.ReplicaId = pf.me
 	viewChangeArgs.LastCheckpointDigest = pf.lastCheckpointDigest
 	viewChangeArgs.LastCheckpointSeqId = pf.lastCheckpointSeqId
+	viewChangeArgs.LastCheckpointProof = pf.lastCheckpointProof
 	viewChangeArgs.PreparedRequestSet = preparedRequestSet
 
+	pf.crashAt(CrashViewChange)
 	pf.broadcast("ViewChange", viewChangeArgs)
+	pf.newViewChangeTimer()
+}
+
+// preparedCertificate collects the proof that a log entry prepared. Only
+// prepares of backups with a valid signature are used, in MAC mode a
+// faulty replica may send one whose MAC is correct only.
+func (pf *Pbft) preparedCertificate(logEntry *LogEntry) (PreparedRequest, bool) {
+	preparedRequest := PreparedRequest{}
+	preparedRequest.Preprepare.ViewId = logEntry.ViewId
+	preparedRequest.Preprepare.SeqId = logEntry.SeqId
+	preparedRequest.Preprepare.Digest = logEntry.Digest
+	preparedRequest.Preprepare.Requests = logEntry.Requests
+	preparedRequest.Preprepare.Signature = logEntry.Signature
+
+	primaryId := logEntry.ViewId % pf.n
+	for _, prepare := range pf.matchingPrepares(logEntry) {
+		if prepare.ReplicaId == primaryId || !pf.verifyReplica(prepare.ReplicaId, prepare) {
+			continue
+		}
+		signedPrepare := *prepare
+		signedPrepare.Authenticator = nil
+		preparedRequest.Prepares = append(preparedRequest.Prepares, signedPrepare)
+	}
+	return preparedRequest, logEntry.Signature != nil && len(preparedRequest.Prepares) >= 2*pf.f
 }
 
-func (pf *Pbft) getReplyFromLog(args *RequestArgs) int {
+// joinViewChange starts a view change without waiting for the own timer
+// once f+1 other replicas move to views above the one this replica is in
+// or moving to, so at least one correct replica suspects the primary. It
+// joins the smallest of these views.
+func (pf *Pbft) joinViewChange() {
+	currentViewId := pf.viewId
+	if pf.viewChanging {
+		currentViewId = pf.nextViewId
+	}
+
+	replicas := make(map[int]bool)
+	minViewId := 0
+	for viewId, viewChanges := range pf.viewChanges {
+		if viewId <= currentViewId {
+			continue
+		}
+		for replicaId := range viewChanges {
+			if replicaId != pf.me {
+				replicas[replicaId] = true
+			}
+		}
+		if minViewId == 0 || viewId < minViewId {
+			minViewId = viewId
+		}
+	}
+
+	if len(replicas) > pf.f {
+		pf.debugPrint(fmt.Sprintf("Join view change: %d replicas moving to View[%d]\n", len(replicas), minViewId))
+		pf.sendViewChange(minViewId)
+	}
+}
+
+func (pf *Pbft) newViewChangeTimer() {
+	if pf.viewChangeTimer != nil {
+		pf.viewChangeTimer.Cancel()
+	}
+	timer := NewTimerWithCancel(time.Duration(pf.viewChangeTimeout) * time.Millisecond)
+	timer.SetTimeout(func() {
+		pf.mu.Lock()
+		defer pf.mu.Unlock()
+		if pf.viewChangeTimer != timer {
+			return
+		}
+		pf.viewChangeTimer = nil
+		pf.debugPrint(fmt.Sprintf("View change timeout: View[%d] after %dms\n", pf.nextViewId, pf.viewChangeTimeout))
+		pf.viewChangeTimeout *= 2
+		pf.sendViewChange(pf.nextViewId + 1)
+	})
+	timer.Start()
+	pf.viewChangeTimer = timer
+}
+
+// enterView installs view viewId once its new-view message is accepted
+// and resumes the normal case.
+func (pf *Pbft) enterView(viewId int) {
+	pf.viewId = viewId
+	pf.nextViewId = viewId
+	pf.viewChanging = false
+	if pf.viewChangeTimer != nil {
+		pf.viewChangeTimer.Cancel()
+		pf.viewChangeTimer = nil
+	}
+	for id := range pf.viewChanges {
+		if id <= viewId {
+			delete(pf.viewChanges, id)
+		}
+	}
+}
+
+// findRequestInLog returns the sequence id assigned to a request that is
+// still in the log, or 0.
+func (pf *Pbft) findRequestInLog(args *RequestArgs) int {
 	// naive way
 	for seqId, log := range pf.logs {
-		if log.Request.ClientId == args.ClientId &&
-			log.Request.Timestamp == args.Timestamp {
-			return seqId
+		for _, request := range log.Requests {
+			if request.ClientId == args.ClientId &&
+				request.Timestamp == args.Timestamp {
+				return seqId
+			}
 		}
 	}
 
 	return 0
 }
 
-func (pf *Pbft) savePrepare(seqId int, replicaId int, digest string) {
-	if pf.prepares[seqId] == nil {
-		pf.prepares[seqId] = make(map[int]string)
+// isPending reports whether a request waits in pendingRequests.
+func (pf *Pbft) isPending(args *RequestArgs) bool {
+	for _, request := range pf.pendingRequests {
+		if request.ClientId == args.ClientId &&
+			request.Timestamp == args.Timestamp {
+			return true
+		}
 	}
-	pf.prepares[seqId][replicaId] = digest
+	return false
 }
 
-func (pf *Pbft) saveCommits(seqId int, replicaId int, digest string) {
-	if pf.commits[seqId] == nil {
-		pf.commits[seqId] = make(map[int]string)
+// savePrepare keeps the latest prepare of every replica for a sequence id
+// and logs it. Prepares of a view the replica has not entered yet are kept
+// as well.
+func (pf *Pbft) savePrepare(args *PrepareArgs) {
+	if pf.storePrepare(args) {
+		record := &Record{}
+		record.Type = PrepareRecord
+		record.Prepare = args
+		pf.persist(record)
+	}
+}
+
+// storePrepare reports whether args replaced the prepare of its replica,
+// a repeated prepare is ignored.
+func (pf *Pbft) storePrepare(args *PrepareArgs) bool {
+	if pf.prepares[args.SeqId] == nil {
+		pf.prepares[args.SeqId] = make(map[int]*PrepareArgs)
+	}
+	prepare, ok := pf.prepares[args.SeqId][args.ReplicaId]
+	if ok && (prepare.ViewId > args.ViewId || (prepare.ViewId == args.ViewId && prepare.Digest == args.Digest)) {
+		return false
 	}
-	pf.commits[seqId][replicaId] = digest
+	pf.prepares[args.SeqId][args.ReplicaId] = args
+	return true
+}
+
+func (pf *Pbft) saveCommits(args *CommitArgs) {
+	if pf.storeCommit(args) {
+		record := &Record{}
+		record.Type = CommitRecord
+		record.Commit = args
+		pf.persist(record)
+	}
+}
+
+func (pf *Pbft) storeCommit(args *CommitArgs) bool {
+	if pf.commits[args.SeqId] == nil {
+		pf.commits[args.SeqId] = make(map[int]*CommitArgs)
+	}
+	commit, ok := pf.commits[args.SeqId][args.ReplicaId]
+	if ok && (commit.ViewId > args.ViewId || (commit.ViewId == args.ViewId && commit.Digest == args.Digest)) {
+		return false
+	}
+	pf.commits[args.SeqId][args.ReplicaId] = args
+	return true
+}
+
+// matchingPrepares returns the prepares for the view and digest of a log
+// entry.
+func (pf *Pbft) matchingPrepares(logEntry *LogEntry) []*PrepareArgs {
+	prepares := make([]*PrepareArgs, 0, len(pf.prepares[logEntry.SeqId]))
+	for _, prepare := range pf.prepares[logEntry.SeqId] {
+		if prepare.ViewId == logEntry.ViewId && prepare.Digest == logEntry.Digest {
+			prepares = append(prepares, prepare)
+		}
+	}
+	return prepares
+}
+
+// matchingCommits counts the commits for the view and digest of a log
+// entry.
+func (pf *Pbft) matchingCommits(logEntry *LogEntry) int {
+	commitCnt := 0
+	for _, commit := range pf.commits[logEntry.SeqId] {
+		if commit.ViewId == logEntry.ViewId && commit.Digest == logEntry.Digest {
+			commitCnt++
+		}
+	}
+	return commitCnt
 }
 
 func (pf *Pbft) processPrepares(seqId int) {
@@ -172,35 +632,32 @@ func (pf *Pbft) processPrepares(seqId int) {
 		return
 	}
 
-	if len(pf.prepares[seqId]) > 2*pf.f {
-		prepares := pf.prepares[seqId]
-		digestCnt := make(map[string]int)
-		maxCnt := 0
-		maxDigest := ""
-		for _, digest := range prepares {
-			digestCnt[digest]++
-			if digestCnt[digest] > maxCnt {
-				maxCnt = digestCnt[digest]
-				maxDigest = digest
-			}
-		}
-
-		if maxCnt <= pf.f {
-			fmt.Println("ERROR: There is no prepare message whose count is more than f!")
-			return
-		}
-
+	if len(pf.matchingPrepares(logEntry)) > 2*pf.f {
 		// go to commit phase
 		logEntry.Phase = PbftPhasecommit
 
 		commitArgs := &CommitArgs{}
 		commitArgs.SeqId = seqId
 		commitArgs.ViewId = pf.viewId
-		commitArgs.Digest = maxDigest
+		commitArgs.Digest = logEntry.Digest
 		commitArgs.ReplicaId = pf.me
+		// in signature mode the commit is signed before it is logged, so
+		// the logged one verifies on replay, in MAC mode it only carries
+		// MACs. The commit is logged before it is sent, a restarted
+		// replica counts it like the ones of the other replicas
+		if pf.authMode == SignatureAuthMode {
+			pf.sign(commitArgs)
+		}
+		pf.saveCommits(commitArgs)
+		pf.crashAt(CrashCommit)
 		pf.broadcast("Commit", commitArgs)
 
-		delete(pf.prepares, seqId)
+		// the prepares stay until the next checkpoint, they prove the
+		// entry prepared in a view change
+		// commits may have arrived before the entry was prepared
+		pf.processCommits(seqId)
+		// otherwise it may be executed tentatively
+		pf.executeCommitted()
 	}
 }
 
@@ -214,49 +671,305 @@ func (pf *Pbft) processCommits(seqId int) {
 		return
 	}
 
-	if len(pf.commits[seqId]) > 2*pf.f {
-		// commit the request and reply to client
+	if pf.matchingCommits(logEntry) > 2*pf.f {
 		logEntry.Phase = PbftPhasecommitted
+		if seqId > pf.maxCommitted {
+			pf.maxCommitted = seqId
+		}
+
+		// the commits stay until the next checkpoint, the compacted log
+		// keeps the entry committed
+		// entries after a gap are held back until the gap is committed
+		pf.executeCommitted()
+	}
+}
+
+// executeCommitted applies every committed entry following lastExecuted
+// to the state machine in sequence order and multicasts a checkpoint at
+// each checkpoint interval. Entries committed after a gap stay buffered
+// in the log until the gap is filled. The prepared entry following the
+// committed ones is executed tentatively.
+func (pf *Pbft) executeCommitted() {
+	defer pf.watchGap()
+	defer pf.answerReadOnly()
+	for {
+		logEntry := pf.logs[pf.lastExecuted+1]
+		if pf.tentative != nil && pf.tentative != logEntry {
+			// the tentatively executed entry was replaced
+			if !pf.rollbackTentative() {
+				return
+			}
+			continue
+		}
+		if logEntry == nil {
+			return
+		}
+		if logEntry.Phase != PbftPhasecommitted {
+			pf.executeTentative(logEntry)
+			return
+		}
+
+		pf.lastExecuted++
+		if pf.tentative == logEntry {
+			pf.commitTentative(logEntry)
+		} else {
+			pf.execute(logEntry, false)
+		}
+
+		if pf.lastExecuted%pf.checkpointInterval == 0 {
+			pf.makeCheckpoint()
+		}
+	}
+}
 
+// executeTentative executes a prepared entry whose predecessors are all
+// committed, so the client can accept its result one round earlier.
+func (pf *Pbft) executeTentative(logEntry *LogEntry) {
+	if pf.tentative != nil || logEntry.Phase != PbftPhasecommit || logEntry.ViewId != pf.viewId {
+		return
+	}
+	pf.tentative = logEntry
+	pf.execute(logEntry, true)
+}
+
+// commitTentative makes the tentative execution of a committed entry
+// final and sends the committed replies.
+func (pf *Pbft) commitTentative(logEntry *LogEntry) {
+	pf.tentative = nil
+	for i := range logEntry.Replies {
+		if logEntry.Replies[i].Timestamp != logEntry.Requests[i].Timestamp {
+			// a skipped request older than the last one of its client
+			continue
+		}
 		replyArgs := &ReplyArgs{}
-		replyArgs.ViewId = pf.viewId
-		replyArgs.ReplicaId = pf.me
-		replyArgs.Timestamp = logEntry.Request.Timestamp
-		// could apply the operation here
-		replyArgs.Result = logEntry.Request.Operation
-		logEntry.Reply = *replyArgs
+		*replyArgs = logEntry.Replies[i]
+		replyArgs.Tentative = false
+		replyArgs.Signature = nil
+		pf.replyClient(logEntry.Requests[i].ClientId, replyArgs)
+		logEntry.Replies[i] = *replyArgs
+	}
+	pf.completeRequests(logEntry)
+	pf.answerReadOnly()
+}
+
+// rollbackTentative undoes a tentative execution by restoring the state of
+// the stable checkpoint. The committed entries after it are executed again
+// by executeCommitted, which answers the queued read-only requests
+// afterwards.
+func (pf *Pbft) rollbackTentative() bool {
+	if pf.tentative == nil {
+		return true
+	}
 
-		pf.replyClient(logEntry.Request.ClientId, replyArgs)
+	pf.debugPrint(fmt.Sprintf("Rollback tentative execution of Request[SeqId %d] to checkpoint %d\n", pf.tentative.SeqId, pf.lastCheckpointSeqId))
+	snapshot, ok := pf.snapshots[pf.lastCheckpointSeqId]
+	if !ok {
+		pf.debugPrint(fmt.Sprintf("Rollback error: no snapshot of checkpoint %d\n", pf.lastCheckpointSeqId))
+		return false
+	}
+	err := pf.restoreState(snapshot)
+	if err != nil {
+		pf.debugPrint(fmt.Sprintf("Rollback error: %s\n", err))
+		return false
+	}
+	pf.tentative = nil
+	pf.lastExecuted = pf.lastCheckpointSeqId
+	return true
+}
 
-		if seqId > pf.maxCommitted {
-			pf.maxCommitted = seqId
-			// multicast checkpoint
-			if pf.maxCommitted-pf.lastCheckpointSeqId > CheckPointSequenceInterval {
-				checkpointArgs := &CheckpointArgs{}
-				checkpointArgs.LastCommitted = pf.maxCommitted
-				// todo: current state to digest
-				checkpointArgs.Digest = "checkpoint " + strconv.Itoa(pf.maxCommitted)
-				checkpointArgs.ReplicaId = pf.me
-				pf.broadcast("Checkpoint", checkpointArgs)
+// watchGap starts a timer while committed entries wait behind a gap. If
+// the gap is still there when it fires, the missing entries are fetched
+// from the peers.
+func (pf *Pbft) watchGap() {
+	if pf.lastExecuted >= pf.maxCommitted {
+		if pf.gapTimer != nil {
+			pf.gapTimer.Cancel()
+			pf.gapTimer = nil
+		}
+		return
+	}
+
+	if pf.gapTimer != nil {
+		return
+	}
+
+	lastExecuted := pf.lastExecuted
+	timer := NewTimerWithCancel(time.Duration(GapTimeout * time.Millisecond))
+	timer.SetTimeout(func() {
+		pf.mu.Lock()
+		defer pf.mu.Unlock()
+		if pf.gapTimer != timer {
+			return
+		}
+		pf.gapTimer = nil
+		if pf.lastExecuted == lastExecuted && pf.lastExecuted < pf.maxCommitted {
+			pf.debugPrint(fmt.Sprintf("Execution gap: executed %d, committed %d\n", pf.lastExecuted, pf.maxCommitted))
+			pf.fetchState(pf.lastCheckpointSeqId)
+		}
+		pf.watchGap()
+	})
+	timer.Start()
+	pf.gapTimer = timer
+}
+
+// execute applies every request of an entry in batch order and replies to
+// each client. A request is only executed if its timestamp is above the
+// one of the last request executed for its client, a request that was
+// ordered again is answered with the cached reply. The replies of a
+// tentative execution are flagged and the requests are completed once the
+// entry commits, a rollback restores the last replies with the state.
+func (pf *Pbft) execute(logEntry *LogEntry, tentative bool) {
+	if len(logEntry.Requests) == 0 {
+		pf.debugPrint(fmt.Sprintf("Execute null request: SeqId[%d]\n", logEntry.SeqId))
+	}
+	logEntry.Replies = make([]ReplyArgs, len(logEntry.Requests))
+	for i, request := range logEntry.Requests {
+		if lastReply, ok := pf.lastReplies[request.ClientId]; ok && request.Timestamp <= lastReply.Timestamp {
+			pf.debugPrint(fmt.Sprintf("Skip executed request: SeqId[%d] Client[%d] Timestamp[%d]\n", logEntry.SeqId, request.ClientId, request.Timestamp))
+			logEntry.Replies[i] = *lastReply
+			if request.Timestamp == lastReply.Timestamp {
+				replyArgs := &ReplyArgs{}
+				*replyArgs = *lastReply
+				pf.replyClient(request.ClientId, replyArgs)
 			}
+			continue
 		}
 
-		timestamp := logEntry.Request.Timestamp
-		if timer, ok := pf.requestTimer[timestamp]; ok {
+		replyArgs := &ReplyArgs{}
+		replyArgs.ViewId = pf.viewId
+		replyArgs.ReplicaId = pf.me
+		replyArgs.Timestamp = request.Timestamp
+		replyArgs.Result = pf.sm.Apply(request.Operation)
+		replyArgs.Tentative = tentative
+
+		pf.replyClient(request.ClientId, replyArgs)
+		logEntry.Replies[i] = *replyArgs
+		// commitTentative updates the reply in place
+		pf.lastReplies[request.ClientId] = &logEntry.Replies[i]
+	}
+	if !tentative {
+		pf.completeRequests(logEntry)
+	}
+}
+
+// completeRequests stops the request timers of the requests of a committed
+// entry.
+func (pf *Pbft) completeRequests(logEntry *LogEntry) {
+	for _, request := range logEntry.Requests {
+		key := requestKey{request.ClientId, request.Timestamp}
+		if timer, ok := pf.requestTimer[key]; ok {
 			timer.Cancel()
-			delete(pf.requestTimer, timestamp)
+			delete(pf.requestTimer, key)
 		}
+	}
+	// the view works, so the next view change starts with the base timeout
+	pf.viewChangeTimeout = ViewChangeTimeout
+}
 
-		delete(pf.commits, seqId)
-		delete(pf.prepares, seqId)
+// executeReadOnly answers a read-only request from the current state
+// without ordering it. Operations that are not read-only are ignored, the
+// client retries them through the ordered path. While a tentative
+// execution is applied, the request is queued until it committed or was
+// rolled back, a client must not accept a state that may be undone.
+func (pf *Pbft) executeReadOnly(args *RequestArgs) {
+	sm, ok := pf.sm.(ReadOnlyStateMachine)
+	if !ok {
+		return
 	}
+	if pf.tentative != nil {
+		pf.readOnlyRequests = append(pf.readOnlyRequests, *args)
+		return
+	}
+	result, err := sm.Query(args.Operation)
+	if err != nil {
+		pf.debugPrint(fmt.Sprintf("Read-only request rejected: %s\n", err))
+		return
+	}
+
+	replyArgs := &ReplyArgs{}
+	replyArgs.ViewId = pf.viewId
+	replyArgs.ReplicaId = pf.me
+	replyArgs.Timestamp = args.Timestamp
+	replyArgs.Result = result
+	pf.replyClient(args.ClientId, replyArgs)
+}
+
+// answerReadOnly answers the queued read-only requests once no tentative
+// execution is applied.
+func (pf *Pbft) answerReadOnly() {
+	if pf.tentative != nil {
+		return
+	}
+	requests := pf.readOnlyRequests
+	pf.readOnlyRequests = nil
+	for i := range requests {
+		pf.executeReadOnly(&requests[i])
+	}
+}
+
+// makeCheckpoint snapshots the state machine and the last replies after
+// the last executed entry and multicasts their digest.
+func (pf *Pbft) makeCheckpoint() {
+	snapshot, err := pf.snapshotState()
+	if err != nil {
+		pf.debugPrint(fmt.Sprintf("Snapshot error at checkpoint %d: %s\n", pf.lastExecuted, err))
+		return
+	}
+	pf.snapshots[pf.lastExecuted] = snapshot
+	if pf.lastExecuted == pf.lastCheckpointSeqId {
+		// the checkpoint became stable before the replica executed up to it
+		pf.saveSnapshot(pf.lastExecuted)
+	}
+
+	checkpointArgs := &CheckpointArgs{}
+	checkpointArgs.LastCommitted = pf.lastExecuted
+	checkpointArgs.Digest = pf.stateDigest()
+	checkpointArgs.ReplicaId = pf.me
+	pf.broadcast("Checkpoint", checkpointArgs)
+	pf.saveCheckpoints(checkpointArgs)
 }
 
-func (pf *Pbft) saveCheckpoints(seqId int, replicaId int, digest string) {
+func (pf *Pbft) saveCheckpoints(args *CheckpointArgs) {
+	seqId := args.LastCommitted
 	if pf.checkpoints[seqId] == nil {
-		pf.checkpoints[seqId] = make(map[int]string)
+		pf.checkpoints[seqId] = make(map[int]*CheckpointArgs)
+	}
+	pf.checkpoints[seqId][args.ReplicaId] = args
+}
+
+// saveFutureCheckpoint keeps the newest checkpoint of a replica above the
+// log window. Once f+1 replicas, so at least one correct one, are past the
+// window, the replica fell behind. The pre-prepares it would need are
+// dropped, so it fetches the state instead.
+func (pf *Pbft) saveFutureCheckpoint(args *CheckpointArgs) {
+	if checkpoint, ok := pf.futureCheckpoints[args.ReplicaId]; ok && checkpoint.LastCommitted >= args.LastCommitted {
+		return
+	}
+	pf.futureCheckpoints[args.ReplicaId] = args
+
+	if len(pf.futureCheckpoints) > pf.f {
+		pf.debugPrint(fmt.Sprintf("Fell behind: %d replicas above the high watermark %d\n", len(pf.futureCheckpoints), pf.highWatermark()))
+		pf.fetchState(pf.highWatermark() + pf.checkpointInterval)
+	}
+}
+
+// acceptFutureCheckpoints counts the kept checkpoints that fell into the
+// log window after a checkpoint became stable.
+func (pf *Pbft) acceptFutureCheckpoints() {
+	seqIds := make([]int, 0)
+	for replicaId, checkpoint := range pf.futureCheckpoints {
+		if checkpoint.LastCommitted > pf.highWatermark() {
+			continue
+		}
+		delete(pf.futureCheckpoints, replicaId)
+		if checkpoint.LastCommitted > pf.lastCheckpointSeqId {
+			pf.saveCheckpoints(checkpoint)
+			seqIds = append(seqIds, checkpoint.LastCommitted)
+		}
+	}
+	for _, seqId := range seqIds {
+		pf.processCheckpoints(seqId)
 	}
-	pf.checkpoints[seqId][replicaId] = digest
 }
 
 func (pf *Pbft) processCheckpoints(seqId int) {
@@ -272,113 +985,339 @@ func (pf *Pbft) processCheckpoints(seqId int) {
 		checkpoints := pf.checkpoints[seqId]
 		digestCnt := make(map[string]int)
 		validDigest := ""
-		for _, digest := range checkpoints {
-			digestCnt[digest]++
-			if digestCnt[digest] > 2*pf.f {
-				validDigest = digest
+		for _, checkpoint := range checkpoints {
+			digestCnt[checkpoint.Digest]++
+			if digestCnt[checkpoint.Digest] > 2*pf.f {
+				validDigest = checkpoint.Digest
 				break
 			}
 		}
 
 		if validDigest != "" {
-			pf.lastCheckpointSeqId = seqId
-			pf.lastCheckpointDigest = validDigest
-			pf.garbageCollect(seqId)
-			pf.viewChanges = make(map[int]map[int]PreparedRequest)
+			proof := make([]CheckpointArgs, 0, len(checkpoints))
+			for _, checkpoint := range checkpoints {
+				if checkpoint.Digest == validDigest {
+					proof = append(proof, *checkpoint)
+				}
+			}
+			pf.stabilizeCheckpoint(seqId, validDigest, proof)
+			for replicaId, checkpoint := range checkpoints {
+				pf.checkCheckpointDigest(seqId, replicaId, checkpoint.Digest)
+			}
+			if pf.lastExecuted < seqId {
+				pf.fetchState(seqId)
+			}
 		}
 	}
 }
 
-func (pf *Pbft) saveViewChange(seqId int, replicaId int, preparedRequestSet map[int]PreparedRequest) {
-	if seqId != pf.lastCheckpointSeqId {
+// stabilizeCheckpoint makes the checkpoint at seqId with its proof the
+// stable checkpoint and discards everything below it.
+func (pf *Pbft) stabilizeCheckpoint(seqId int, digest string, proof []CheckpointArgs) {
+	pf.persistCheckpoint(seqId, digest, proof)
+
+	pf.lastCheckpointSeqId = seqId
+	pf.lastCheckpointDigest = digest
+	pf.lastCheckpointProof = proof
+	pf.garbageCollect(seqId)
+	pf.compactStorage()
+	if pf.recoverySeqId != 0 && seqId >= pf.recoverySeqId {
+		pf.debugPrint(fmt.Sprintf("Recovery complete at checkpoint %d\n", seqId))
+		pf.recoverySeqId = 0
+	}
+	if pf.isPrimary() {
+		pf.proposePending(true)
+	}
+	pf.acceptFuturePreprepares()
+	pf.acceptFutureCheckpoints()
+}
+
+func (pf *Pbft) checkCheckpointDigest(seqId int, replicaId int, digest string) {
+	if seqId != pf.lastCheckpointSeqId || digest == pf.lastCheckpointDigest {
 		return
 	}
 
-	// check valid prepared request
-	for seqId, preparedRequest := range preparedRequestSet {
-		if preparedRequest.Request.ViewId != pf.viewId {
-			delete(preparedRequestSet, seqId)
+	if replicaId == pf.me {
+		pf.divergedSeqId = seqId
+		pf.debugPrint(fmt.Sprintf("State diverged: local checkpoint[%d] digest %s does not match stable digest %s\n", seqId, digest, pf.lastCheckpointDigest))
+	} else {
+		pf.debugPrint(fmt.Sprintf("State diverged: Replica[%d] checkpoint[%d] digest %s does not match stable digest %s\n", replicaId, seqId, digest, pf.lastCheckpointDigest))
+	}
+}
+
+// saveViewChange stores a view-change message once the certificates it
+// carries are verified. Only the message for the highest view of every
+// replica is kept, a correct replica only moves to higher views and a
+// faulty one can not make the replica keep one message per view.
+func (pf *Pbft) saveViewChange(args *ViewChangeArgs) bool {
+	if !pf.validViewChange(args) {
+		return false
+	}
+
+	for viewId, viewChanges := range pf.viewChanges {
+		if _, ok := viewChanges[args.ReplicaId]; !ok || viewId == args.ViewId {
 			continue
 		}
+		if viewId > args.ViewId {
+			return true
+		}
+		delete(viewChanges, args.ReplicaId)
+		if len(viewChanges) == 0 {
+			delete(pf.viewChanges, viewId)
+		}
+	}
 
-		if preparedRequest.Request.SeqId < pf.lastCheckpointSeqId {
-			delete(preparedRequestSet, seqId)
-			continue
+	if pf.viewChanges[args.ViewId] == nil {
+		pf.viewChanges[args.ViewId] = make(map[int]*ViewChangeArgs)
+	}
+	pf.viewChanges[args.ViewId][args.ReplicaId] = args
+	return true
+}
+
+// validViewChange checks the proof of the stable checkpoint of a
+// view-change message and of every request it claims prepared. The
+// initial checkpoint needs no proof.
+func (pf *Pbft) validViewChange(args *ViewChangeArgs) bool {
+	if args.LastCheckpointSeqId != 0 &&
+		!pf.verifyCheckpointProof(args.LastCheckpointSeqId, args.LastCheckpointDigest, args.LastCheckpointProof) {
+		return false
+	}
+
+	for seqId := range args.PreparedRequestSet {
+		preparedRequest := args.PreparedRequestSet[seqId]
+		if !pf.validPreparedRequest(args, seqId, &preparedRequest) {
+			return false
 		}
+	}
+	return true
+}
+
+// validPreparedRequest checks a prepared request of a view-change message
+// only against the message itself, so the new primary and the backups
+// agree on it. The pre-prepare must be signed by the primary of its view
+// and matched by the signed prepares of 2f distinct backups.
+func (pf *Pbft) validPreparedRequest(viewChange *ViewChangeArgs, seqId int, preparedRequest *PreparedRequest) bool {
+	preprepare := &preparedRequest.Preprepare
+	if preprepare.SeqId != seqId || preprepare.ViewId >= viewChange.ViewId {
+		return false
+	}
+
+	if seqId <= viewChange.LastCheckpointSeqId || seqId > viewChange.LastCheckpointSeqId+pf.logWindow {
+		return false
+	}
 
-		prepares := preparedRequest.Prepares
-		if len(prepares) <= 2*pf.f {
-			delete(preparedRequestSet, seqId)
+	primaryId := preprepare.ViewId % pf.n
+	if batchDigest(preprepare.Requests) != preprepare.Digest || !pf.verifyReplica(primaryId, preprepare) {
+		return false
+	}
+
+	replicas := make(map[int]bool)
+	for i := range preparedRequest.Prepares {
+		prepare := &preparedRequest.Prepares[i]
+		if prepare.ViewId != preprepare.ViewId || prepare.SeqId != seqId || prepare.Digest != preprepare.Digest {
 			continue
 		}
+		if prepare.ReplicaId == primaryId || replicas[prepare.ReplicaId] || !pf.verifyReplica(prepare.ReplicaId, prepare) {
+			continue
+		}
+		replicas[prepare.ReplicaId] = true
+	}
+	return len(replicas) >= 2*pf.f
+}
 
-		isValid := false
-		digestCnt := make(map[string]int)
-		for _, digest := range prepares {
-			digestCnt[digest]++
-			if digestCnt[digest] > 2*pf.f {
-				isValid = true
-				break
+// computeNewPreprepares derives the pre-prepares of view viewId from a set
+// of view-change messages. Every sequence id above the stable checkpoint
+// that was prepared at some replica is assigned the request prepared in
+// the highest view, the gaps up to the highest prepared one are filled
+// with null requests. The result does not depend on local state, the
+// view-change messages must have been validated before.
+func (pf *Pbft) computeNewPreprepares(viewId int, viewChanges []ViewChangeArgs) map[int]PrePrepareAgrs {
+	minSeq := 0
+	for i := range viewChanges {
+		if viewChanges[i].LastCheckpointSeqId > minSeq {
+			minSeq = viewChanges[i].LastCheckpointSeqId
+		}
+	}
+
+	maxSeq := minSeq
+	selected := make(map[int]*PrePrepareAgrs)
+	for i := range viewChanges {
+		viewChange := &viewChanges[i]
+		for seqId := range viewChange.PreparedRequestSet {
+			if seqId <= minSeq {
+				continue
+			}
+
+			preparedRequest := viewChange.PreparedRequestSet[seqId]
+			preprepare := &preparedRequest.Preprepare
+			current, ok := selected[seqId]
+			if !ok || preprepare.ViewId > current.ViewId ||
+				(preprepare.ViewId == current.ViewId && preprepare.Digest < current.Digest) {
+				selected[seqId] = preprepare
+			}
+			if seqId > maxSeq {
+				maxSeq = seqId
 			}
 		}
+	}
 
-		if !isValid {
-			delete(preparedRequestSet, seqId)
+	newPreprepares := make(map[int]PrePrepareAgrs)
+	for seqId := minSeq + 1; seqId <= maxSeq; seqId++ {
+		// a null request is an empty batch, it executes nothing
+		var requests []RequestArgs
+		if preprepare, ok := selected[seqId]; ok {
+			requests = preprepare.Requests
 		}
+
+		preprepareArgs := PrePrepareAgrs{}
+		preprepareArgs.ViewId = viewId
+		preprepareArgs.SeqId = seqId
+		preprepareArgs.Requests = requests
+		preprepareArgs.Digest = batchDigest(requests)
+		newPreprepares[seqId] = preprepareArgs
 	}
+	return newPreprepares
+}
 
-	pf.viewChanges[replicaId] = preparedRequestSet
+// verifyViewChanges checks that a new-view message is based on 2f+1
+// correctly signed view-change messages for its view from distinct
+// replicas, each with valid certificates.
+func (pf *Pbft) verifyViewChanges(viewId int, viewChanges []ViewChangeArgs) bool {
+	replicas := make(map[int]bool)
+	for i := range viewChanges {
+		viewChange := &viewChanges[i]
+		if viewChange.ViewId != viewId || replicas[viewChange.ReplicaId] {
+			return false
+		}
+		if !pf.verifyReplica(viewChange.ReplicaId, viewChange) || !pf.validViewChange(viewChange) {
+			return false
+		}
+		replicas[viewChange.ReplicaId] = true
+	}
+	return len(replicas) > 2*pf.f
+}
+
+// verifyNewPreprepares checks that the pre-prepares of a new-view message
+// are exactly the ones computed from its view-change messages.
+func (pf *Pbft) verifyNewPreprepares(args *NewViewArgs) bool {
+	expected := pf.computeNewPreprepares(args.ViewId, args.ViewChanges)
+	if len(expected) != len(args.NewPreprepares) {
+		return false
+	}
+
+	for seqId, preprepareArgs := range expected {
+		newPreprepare, ok := args.NewPreprepares[seqId]
+		if !ok || newPreprepare.ViewId != preprepareArgs.ViewId || newPreprepare.SeqId != seqId {
+			return false
+		}
+		if newPreprepare.Digest != preprepareArgs.Digest || batchDigest(newPreprepare.Requests) != newPreprepare.Digest {
+			return false
+		}
+	}
+	return true
 }
 
+// provessViewChange multicasts the new-view message once the primary of
+// viewId has 2f+1 view-change messages for it, and enters the view.
 func (pf *Pbft) provessViewChange(viewId int) {
 	// only primary
 	if (viewId)%pf.n != pf.me {
 		return
 	}
 
-	if len(pf.viewChanges) > 2*pf.f {
-		// combine all prepared requests
-		minSeq := pf.seqId
-		maxSeq := pf.lastCheckpointSeqId
-		allPreparedRequests := make(map[int]PreparedRequest)
-		for _, PreparedRequestSet := range pf.viewChanges {
-			for seqId, preparedRequest := range PreparedRequestSet {
-				allPreparedRequests[seqId] = preparedRequest
-				if seqId > maxSeq {
-					maxSeq = seqId
-				}
+	if viewId <= pf.viewId || len(pf.viewChanges[viewId]) <= 2*pf.f {
+		return
+	}
 
-				if seqId < minSeq {
-					minSeq = seqId
-				}
+	viewChanges := make([]ViewChangeArgs, 0, len(pf.viewChanges[viewId]))
+	for _, viewChange := range pf.viewChanges[viewId] {
+		viewChanges = append(viewChanges, *viewChange)
+	}
+
+	newPreprepares := pf.computeNewPreprepares(viewId, viewChanges)
+	for seqId := range newPreprepares {
+		preprepareArgs := newPreprepares[seqId]
+		pf.sign(&preprepareArgs)
+		newPreprepares[seqId] = preprepareArgs
+	}
+
+	newViewAgrs := &NewViewArgs{}
+	newViewAgrs.ViewId = viewId
+	newViewAgrs.ViewChanges = viewChanges
+	newViewAgrs.NewPreprepares = newPreprepares
+	pf.broadcast("NewView", newViewAgrs)
+	pf.installNewView(newViewAgrs)
+}
+
+// installNewView enters the view of a valid new-view message and runs the
+// pre-prepares for the requests carried over from the previous views. The
+// message is kept for replicas that missed it.
+func (pf *Pbft) installNewView(args *NewViewArgs) {
+	// a tentative execution may be aborted by the view change
+	pf.enterView(args.ViewId)
+	pf.newView = args
+	if pf.rollbackTentative() {
+		pf.executeCommitted()
+	}
+
+	// entries of previous views that were not carried over can not commit
+	// anymore, the new primary continues right after the carried over ones
+	// so that no gap is left
+	pf.seqId = pf.lastCheckpointSeqId
+	for seqId, logEntry := range pf.logs {
+		if logEntry.Phase == PbftPhasecommitted {
+			if seqId > pf.seqId {
+				pf.seqId = seqId
 			}
+			continue
+		}
+		delete(pf.logs, seqId)
+	}
+	for seqId := range args.NewPreprepares {
+		preprepareArgs := args.NewPreprepares[seqId]
+		delete(pf.logs, seqId)
+		if seqId > pf.seqId {
+			pf.seqId = seqId
 		}
 
-		// find all not committed message between minSeq ~ maxSeq
-		// and generate new preprepare messages
-		newPreprepares := make(map[int]PrePrepareAgrs)
-		for seqId, logEntry := range pf.logs {
-			if seqId >= minSeq && seqId <= maxSeq {
-				if logEntry.ViewId == pf.viewId && logEntry.Phase != PbftPhasecommitted {
-					preprepareArgs := PrePrepareAgrs{}
-					preprepareArgs.ViewId = pf.viewId + 1
-					preprepareArgs.SeqId = seqId
-					preprepareArgs.Request = logEntry.Request
-					// todo: digest
-					preprepareArgs.Digest = logEntry.Request.Operation.(string)
-					newPreprepares[seqId] = preprepareArgs
-				}
-			}
+		reply := &DefaultReply{}
+		go pf.Preprepare(&preprepareArgs, reply)
+	}
+	pf.persistMetadata()
+	pf.installViewCheckpoint(args.ViewChanges)
+	// pre-prepares of the new view may have arrived before it
+	pf.acceptFuturePreprepares()
+}
+
+// installViewCheckpoint moves the low watermark to the highest checkpoint
+// proven by the view-change messages a view is based on, the new view
+// starts after it. A replica that has not executed up to it fetches the
+// state from its peers.
+func (pf *Pbft) installViewCheckpoint(viewChanges []ViewChangeArgs) {
+	var latest *ViewChangeArgs
+	for i := range viewChanges {
+		if latest == nil || viewChanges[i].LastCheckpointSeqId > latest.LastCheckpointSeqId {
+			latest = &viewChanges[i]
 		}
+	}
+	if latest == nil || latest.LastCheckpointSeqId <= pf.lastCheckpointSeqId {
+		return
+	}
 
-		newViewAgrs := &NewViewArgs{}
-		newViewAgrs.ViewId = pf.viewId + 1
-		newViewAgrs.PreparedRequestSet = allPreparedRequests
-		newViewAgrs.NewPreprepares = newPreprepares
-		pf.broadcast("NewView", newViewAgrs)
+	seqId := latest.LastCheckpointSeqId
+	pf.debugPrint(fmt.Sprintf("View[%d] starts at checkpoint %d\n", pf.viewId, seqId))
+	if pf.seqId < seqId {
+		pf.seqId = seqId
+	}
+	pf.stabilizeCheckpoint(seqId, latest.LastCheckpointDigest, latest.LastCheckpointProof)
+	if pf.lastExecuted < seqId {
+		pf.fetchState(seqId)
 	}
 }
 
+// garbageCollect discards every message at or below the stable
+// checkpoint seqId. Checkpoint messages for seqId itself are kept as the
+// proof of the stable checkpoint.
 func (pf *Pbft) garbageCollect(seqId int) {
 	for id := range pf.prepares {
 		if id <= seqId {
@@ -388,18 +1327,24 @@ func (pf *Pbft) garbageCollect(seqId int) {
 
 	for id := range pf.commits {
 		if id <= seqId {
-			delete(pf.prepares, id)
+			delete(pf.commits, id)
 		}
 	}
 
 	for id := range pf.checkpoints {
-		if id <= seqId {
-			delete(pf.prepares, id)
+		if id < seqId {
+			delete(pf.checkpoints, id)
 		}
 	}
 
-	for id, log := range pf.logs {
-		if id <= seqId && log.Phase != PbftPhasecommitted {
+	for id := range pf.snapshots {
+		if id < seqId {
+			delete(pf.snapshots, id)
+		}
+	}
+
+	for id := range pf.logs {
+		if id <= seqId {
 			delete(pf.logs, id)
 		}
 	}
@@ -412,7 +1357,22 @@ func (pf *Pbft) getServerInfo() map[string]interface{} {
 	info["id"] = pf.me
 	info["viewId"] = pf.viewId
 	info["seqId"] = pf.seqId
+	info["lastExecuted"] = pf.lastExecuted
 	info["n"] = pf.n
+	info["lastCheckpointSeqId"] = pf.lastCheckpointSeqId
+	info["stateDigest"] = pf.stateDigest()
+	info["divergedSeqId"] = pf.divergedSeqId
+	info["logWindow"] = pf.logWindow
+	info["windowUsed"] = pf.windowUsed()
+	info["windowPeak"] = pf.windowPeak
+	info["pendingRequests"] = len(pf.pendingRequests)
+	info["heldBackRequests"] = pf.heldBackRequests
+	futurePreprepares := 0
+	for _, preprepares := range pf.futurePreprepares {
+		futurePreprepares += len(preprepares)
+	}
+	info["futurePreprepares"] = futurePreprepares
+	info["recoverySeqId"] = pf.recoverySeqId
 	return info
 }
 
@@ -420,27 +1380,75 @@ func (pf *Pbft) debugPrint(msg string) {
 	pf.debugCh <- msg
 }
 
-func MakePbft(id int, serverPeers, clientPeers []peerWrapper, debugCh chan interface{}) *Pbft {
+// MakePbft creates a replica. The defaults of config are filled in before
+// it is used, the config is validated against the auth mode of keys.
+func MakePbft(id int, serverPeers, clientPeers []*peerWrapper, keys *KeyConfig, config *Config, sm StateMachine, storage Storage, debugCh chan interface{}) (*Pbft, error) {
+	err := config.Validate(keys.AuthMode)
+	if err != nil {
+		return nil, err
+	}
+
 	pf := &Pbft{}
 	pf.mu = &sync.Mutex{}
 	pf.servers = serverPeers
 	pf.me = id
 	pf.clients = clientPeers
+	pf.sm = sm
+	pf.initialSnapshot, _ = sm.Snapshot()
+	pf.checkpointInterval = config.CheckpointInterval
+	pf.logWindow = config.LogWindow
+	pf.recoveryInterval = config.RecoveryInterval
+	pf.storage = storage
+	pf.n = len(pf.servers)
+	pf.f = (pf.n - 1) / 3
+	pf.privateKey = keys.PrivateKey
+	pf.serverKeys = keys.ServerKeys
+	pf.clientKeys = keys.ClientKeys
+	pf.authMode = keys.AuthMode
+	pf.auth = newAuthenticator(keys, serverNode(id), id)
+	pf.debugCh = debugCh
+	pf.reset()
+
+	return pf, nil
+}
+
+// reset puts the replica into the state of a freshly started one, with
+// the initial state of the state machine. The configuration, the keys and
+// the storage are kept.
+func (pf *Pbft) reset() {
 	pf.viewId = 0
 	pf.seqId = 0
 	pf.logs = make(map[int]*LogEntry)
-	pf.requestTimer = make(map[int64]*TimerWithCancel)
-	pf.prepares = make(map[int]map[int]string)
-	pf.commits = make(map[int]map[int]string)
-	pf.checkpoints = make(map[int]map[int]string)
-	pf.viewChanges = make(map[int]map[int]PreparedRequest)
+	pf.requestTimer = make(map[requestKey]*TimerWithCancel)
+	pf.prepares = make(map[int]map[int]*PrepareArgs)
+	pf.commits = make(map[int]map[int]*CommitArgs)
+	pf.checkpoints = make(map[int]map[int]*CheckpointArgs)
+	pf.viewChanges = make(map[int]map[int]*ViewChangeArgs)
+	pf.viewChanging = false
+	pf.newView = nil
+	pf.nextViewId = 0
+	pf.viewChangeTimer = nil
+	pf.viewChangeTimeout = ViewChangeTimeout
 	pf.maxCommitted = 0
+	pf.lastExecuted = 0
+	pf.tentative = nil
+	pf.readOnlyRequests = nil
+	pf.gapTimer = nil
+	pf.lastReplies = make(map[int]*ReplyArgs)
+	pf.pendingRequests = nil
+	pf.batchTimer = nil
+	pf.futurePreprepares = make(map[int]map[int]*PrePrepareAgrs)
+	pf.futureCheckpoints = make(map[int]*CheckpointArgs)
+	pf.sm.Restore(pf.initialSnapshot)
+	pf.snapshots = make(map[int][]byte)
+	// the initial state is the rollback target before the first checkpoint
+	pf.snapshots[0], _ = pf.snapshotState()
+	pf.divergedSeqId = 0
 	pf.lastCheckpointSeqId = 0
-	pf.n = len(pf.servers)
-	pf.f = (pf.n - 1) / 3
-	pf.debugCh = debugCh
+	pf.lastCheckpointDigest = ""
+	pf.lastCheckpointProof = nil
+	pf.windowPeak = 0
+	pf.heldBackRequests = 0
 	pf.maliciousModes = make(map[string]MaliciousBehaviorMode)
 	pf.setAllMaliciousMode(NormalMode)
-
-	return pf
 }
@@ -0,0 +1,833 @@
+package pbft
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 30 * time.Second
+
+// testCluster runs the replicas and clients of a cluster in the test
+// process, each with its own rpc server on a local port. Replicas with a
+// storage can be crashed and restarted from it.
+type testCluster struct {
+	t           *testing.T
+	config      *Config
+	serverAddrs []string
+	clientAddrs []string
+	serverKeys  []*KeyConfig
+	clientKeys  []*KeyConfig
+	listeners   []*testListener
+	storages    []Storage
+	crashed     []chan interface{}
+	replicas    []*Pbft
+	clients     []*Client
+	results     []chan string
+}
+
+// testListener remembers the connections it accepted, closing it closes
+// them as well.
+type testListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns = append(l.conns, conn)
+	return conn, nil
+}
+
+func (l *testListener) Close() error {
+	err := l.Listener.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+	return err
+}
+
+func newTestKeys(n int) ([]ed25519.PublicKey, []ed25519.PrivateKey) {
+	pubs := make([]ed25519.PublicKey, n)
+	privs := make([]ed25519.PrivateKey, n)
+	for i := 0; i < n; i++ {
+		pubs[i], privs[i], _ = ed25519.GenerateKey(rand.Reader)
+	}
+	return pubs, privs
+}
+
+func newTestMacKeys(n int) ([]*ecdh.PublicKey, []*ecdh.PrivateKey) {
+	pubs := make([]*ecdh.PublicKey, n)
+	privs := make([]*ecdh.PrivateKey, n)
+	for i := 0; i < n; i++ {
+		privs[i], _ = ecdh.X25519().GenerateKey(rand.Reader)
+		pubs[i] = privs[i].PublicKey()
+	}
+	return pubs, privs
+}
+
+// listen listens on addr, a restarted replica gets the address it had
+// before.
+func listen(t *testing.T, addr string) *testListener {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			return &testListener{Listener: l}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func serve(l net.Listener, rcvr interface{}) {
+	server := rpc.NewServer()
+	server.Register(rcvr)
+	go http.Serve(l, server)
+}
+
+func discard(debugCh chan interface{}) {
+	for range debugCh {
+	}
+}
+
+// newTestCluster starts a cluster of n replicas and the clients that
+// authenticate in authMode. With persistent set every replica logs to a
+// memory storage.
+func newTestCluster(t *testing.T, n int, clients int, config *Config, authMode AuthMode, persistent bool) *testCluster {
+	c := &testCluster{}
+	c.t = t
+	c.config = config
+	serverPubs, serverPrivs := newTestKeys(n)
+	clientPubs, clientPrivs := newTestKeys(clients)
+	serverMacPubs, serverMacPrivs := newTestMacKeys(n)
+	clientMacPubs, clientMacPrivs := newTestMacKeys(clients)
+	for id := 0; id < n; id++ {
+		keys := &KeyConfig{}
+		keys.AuthMode = authMode
+		keys.PrivateKey = serverPrivs[id]
+		keys.ServerKeys = serverPubs
+		keys.ClientKeys = clientPubs
+		keys.MacKey = serverMacPrivs[id]
+		keys.ServerMacKeys = serverMacPubs
+		keys.ClientMacKeys = clientMacPubs
+		c.serverKeys = append(c.serverKeys, keys)
+
+		l := listen(t, "127.0.0.1:0")
+		c.listeners = append(c.listeners, l)
+		c.serverAddrs = append(c.serverAddrs, l.Addr().String())
+		c.crashed = append(c.crashed, make(chan interface{}, 1))
+		if persistent {
+			c.storages = append(c.storages, NewMemoryStorage())
+		} else {
+			c.storages = append(c.storages, nil)
+		}
+	}
+
+	clientListeners := make([]net.Listener, clients)
+	for id := 0; id < clients; id++ {
+		keys := &KeyConfig{}
+		keys.AuthMode = authMode
+		keys.PrivateKey = clientPrivs[id]
+		keys.ServerKeys = serverPubs
+		keys.ClientKeys = clientPubs
+		keys.MacKey = clientMacPrivs[id]
+		keys.ServerMacKeys = serverMacPubs
+		keys.ClientMacKeys = clientMacPubs
+		c.clientKeys = append(c.clientKeys, keys)
+
+		clientListeners[id] = listen(t, "127.0.0.1:0")
+		c.clientAddrs = append(c.clientAddrs, clientListeners[id].Addr().String())
+	}
+
+	c.replicas = make([]*Pbft, n)
+	for id := 0; id < n; id++ {
+		c.startReplica(id)
+	}
+	for id := 0; id < clients; id++ {
+		c.startClient(id, clientListeners[id])
+	}
+	t.Cleanup(func() {
+		for _, l := range c.listeners {
+			if l != nil {
+				l.Close()
+			}
+		}
+		for _, l := range clientListeners {
+			l.Close()
+		}
+	})
+	return c
+}
+
+// startReplica starts a replica, or restarts a crashed one from its
+// storage.
+func (c *testCluster) startReplica(id int) {
+	debugCh := make(chan interface{}, 1024)
+	go discard(debugCh)
+	servers := createPeers(c.serverAddrs)
+	clients := createPeers(c.clientAddrs)
+	pf, err := MakePbft(id, servers, clients, c.serverKeys[id], c.config, NewEchoStateMachine(), c.storages[id], debugCh)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	pf.onCrash = func() {
+		c.disconnect(id, pf)
+	}
+	if c.storages[id] != nil {
+		err = pf.restore()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	if c.listeners[id] == nil {
+		c.listeners[id] = listen(c.t, c.serverAddrs[id])
+	}
+	c.replicas[id] = pf
+	serve(c.listeners[id], pf)
+}
+
+// disconnect cuts a crashed replica off from the network. It is called
+// with the lock of the replica held.
+func (c *testCluster) disconnect(id int, pf *Pbft) {
+	c.listeners[id].Close()
+	c.listeners[id] = nil
+	for _, peer := range pf.servers {
+		peer.close()
+	}
+	for _, peer := range pf.clients {
+		peer.close()
+	}
+	c.crashed[id] <- pf
+}
+
+// kill crashes a replica wherever it is.
+func (c *testCluster) kill(id int) {
+	pf := c.replicas[id]
+	pf.mu.Lock()
+	pf.crash()
+	pf.mu.Unlock()
+	<-c.crashed[id]
+}
+
+// replace crashes a replica and serves rcvr as the replica at its address,
+// so a test can play a faulty replica.
+func (c *testCluster) replace(id int, rcvr interface{}) {
+	c.kill(id)
+	c.listeners[id] = listen(c.t, c.serverAddrs[id])
+	server := rpc.NewServer()
+	server.RegisterName("Pbft", rcvr)
+	go http.Serve(c.listeners[id], server)
+}
+
+// waitCrashed waits until a replica reached its crash point.
+func (c *testCluster) waitCrashed(id int) error {
+	select {
+	case <-c.crashed[id]:
+		return nil
+	case <-time.After(testTimeout):
+		return fmt.Errorf("replica %d did not crash", id)
+	}
+}
+
+// startClient starts a client whose accepted results are passed to its
+// results channel.
+func (c *testCluster) startClient(id int, l net.Listener) {
+	debugCh := make(chan interface{}, 1024)
+	results := make(chan string, 1024)
+	go func() {
+		for msg := range debugCh {
+			if strings.Contains(msg.(string), " got Result[") {
+				results <- msg.(string)
+			}
+		}
+	}()
+	client := MakeClient(id, createPeers(c.serverAddrs), c.clientKeys[id], debugCh)
+	c.clients = append(c.clients, client)
+	c.results = append(c.results, results)
+	serve(l, client)
+}
+
+// request sends an operation from a client and waits until the client
+// accepted its result.
+func (c *testCluster) request(clientId int, command string) error {
+	c.clients[clientId].newRequest([]byte(command), command, false)
+	return c.await(clientId, command)
+}
+
+// await waits for the result of a command sent by a client.
+func (c *testCluster) await(clientId int, command string) error {
+	expected := fmt.Sprintf("Command[%s] got Result[%s]", command, command)
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg := <-c.results[clientId]:
+			if strings.Contains(msg, expected) {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("%s got no result", command)
+		}
+	}
+}
+
+// waitApplied waits until every replica applied applied operations.
+func (c *testCluster) waitApplied(applied int) {
+	deadline := time.Now().Add(testTimeout)
+	for id := range c.replicas {
+		for {
+			pf := c.replicas[id]
+			pf.mu.Lock()
+			done := pf.sm.(*EchoStateMachine).Applied
+			pf.mu.Unlock()
+			if done == applied {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.t.Fatalf("replica %d applied %d operations, expected %d", id, done, applied)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// TestCheckpointGarbageCollection orders thousands of requests from
+// concurrent clients. The log window has to move at every stable
+// checkpoint for the cluster to keep going, and everything below the
+// stable checkpoint has to be discarded.
+func TestCheckpointGarbageCollection(t *testing.T) {
+	const clients = 16
+	const requests = 125
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 20
+	c := newTestCluster(t, 4, clients, config, SignatureAuthMode, false)
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, clients)
+	for id := 0; id < clients; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				err := c.request(id, fmt.Sprintf("op %d-%d", id, i))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	c.waitApplied(clients * requests)
+
+	digests := make(map[string]bool)
+	for id, pf := range c.replicas {
+		pf.mu.Lock()
+		if pf.lastCheckpointSeqId < 5*config.CheckpointInterval {
+			t.Errorf("replica %d: stable checkpoint %d after %d sequence ids", id, pf.lastCheckpointSeqId, pf.lastExecuted)
+		}
+		if pf.windowPeak > config.LogWindow {
+			t.Errorf("replica %d: window peak %d above the log window %d", id, pf.windowPeak, config.LogWindow)
+		}
+		if len(pf.logs) > config.LogWindow {
+			t.Errorf("replica %d: %d log entries kept", id, len(pf.logs))
+		}
+		for seqId := range pf.checkpoints {
+			if seqId < pf.lastCheckpointSeqId {
+				t.Errorf("replica %d: checkpoint %d kept below the stable checkpoint %d", id, seqId, pf.lastCheckpointSeqId)
+			}
+		}
+		for seqId := range pf.snapshots {
+			if seqId < pf.lastCheckpointSeqId {
+				t.Errorf("replica %d: snapshot %d kept below the stable checkpoint %d", id, seqId, pf.lastCheckpointSeqId)
+			}
+		}
+		digests[pf.sm.Digest()] = true
+		pf.mu.Unlock()
+	}
+	if len(digests) != 1 {
+		t.Errorf("replicas ended in %d different states", len(digests))
+	}
+}
+
+// TestExecuteOnce executes a request that was ordered twice, in the same
+// batch and in a later entry, and a request older than it. Only the first
+// one changes the state.
+func TestExecuteOnce(t *testing.T) {
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 20
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, false)
+	pf := c.replicas[1]
+
+	request := RequestArgs{}
+	request.Operation = []byte("op")
+	request.Timestamp = 2
+	older := request
+	older.Timestamp = 1
+	first := &LogEntry{}
+	first.SeqId = 1
+	first.Requests = []RequestArgs{request, request}
+	second := &LogEntry{}
+	second.SeqId = 2
+	second.Requests = []RequestArgs{older, request}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.execute(first, false)
+	pf.execute(second, false)
+	if applied := pf.sm.(*EchoStateMachine).Applied; applied != 1 {
+		t.Errorf("request applied %d times", applied)
+	}
+	if pf.lastReplies[0].Timestamp != request.Timestamp {
+		t.Errorf("last reply has timestamp %d, expected %d", pf.lastReplies[0].Timestamp, request.Timestamp)
+	}
+}
+
+// TestRollbackTentative executes a committed entry and tentatively the
+// prepared one after it, then installs a new view that does not carry the
+// prepared entry over. The tentative execution is rolled back to the
+// stable checkpoint and only the committed entry is executed again.
+func TestRollbackTentative(t *testing.T) {
+	config := &Config{}
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, false)
+	pf := c.replicas[1]
+
+	request := RequestArgs{}
+	request.Operation = []byte("op")
+	request.Timestamp = 1
+	committed := &LogEntry{}
+	committed.SeqId = 1
+	committed.Phase = PbftPhasecommitted
+	committed.Requests = []RequestArgs{request}
+	request.Timestamp = 2
+	prepared := &LogEntry{}
+	prepared.SeqId = 2
+	prepared.Phase = PbftPhasecommit
+	prepared.Requests = []RequestArgs{request}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.logs[1] = committed
+	pf.logs[2] = prepared
+	pf.maxCommitted = 1
+	pf.executeCommitted()
+	if applied := pf.sm.(*EchoStateMachine).Applied; applied != 2 || pf.tentative != prepared {
+		t.Fatalf("%d operations applied, the prepared entry was not executed tentatively", applied)
+	}
+
+	newView := &NewViewArgs{}
+	newView.ViewId = 1
+	pf.installNewView(newView)
+	if applied := pf.sm.(*EchoStateMachine).Applied; applied != 1 {
+		t.Errorf("%d operations applied after the rollback, expected the committed one", applied)
+	}
+	if pf.tentative != nil || pf.lastExecuted != 1 || pf.logs[2] != nil {
+		t.Errorf("executed %d entries, the aborted entry is still tentative or logged", pf.lastExecuted)
+	}
+	if pf.lastReplies[0].Timestamp != 1 {
+		t.Errorf("last reply has timestamp %d, the aborted request is still answered", pf.lastReplies[0].Timestamp)
+	}
+}
+
+// TestMakePbftConfig creates replicas with a zero config, which selects
+// the defaults, and with invalid ones.
+func TestMakePbftConfig(t *testing.T) {
+	pubs, privs := newTestKeys(4)
+	keys := &KeyConfig{}
+	keys.PrivateKey = privs[0]
+	keys.ServerKeys = pubs
+	debugCh := make(chan interface{}, 1024)
+	go discard(debugCh)
+	servers := createPeers([]string{"", "", "", ""})
+
+	pf, err := MakePbft(0, servers, nil, keys, &Config{}, NewEchoStateMachine(), nil, debugCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf.checkpointInterval != DefaultCheckpointInterval || pf.logWindow != DefaultLogWindow {
+		t.Errorf("checkpoint interval %d and log window %d are not the defaults", pf.checkpointInterval, pf.logWindow)
+	}
+
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 5
+	_, err = MakePbft(0, servers, nil, keys, config, NewEchoStateMachine(), nil, debugCh)
+	if err == nil {
+		t.Error("log window smaller than the checkpoint interval accepted")
+	}
+
+	config = &Config{}
+	config.RecoveryInterval = 1000
+	_, err = MakePbft(0, servers, nil, keys, config, NewEchoStateMachine(), nil, debugCh)
+	if err == nil {
+		t.Error("proactive recovery accepted in signature mode")
+	}
+}
+
+// TestInvalidNewView sends new-view messages signed by a faulty replica
+// without the view-change messages they need. They must not move a
+// replica to another view, whether it is changing views or not.
+func TestInvalidNewView(t *testing.T) {
+	config := &Config{}
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, false)
+	faulty := 1
+	pf := c.replicas[2]
+	newView := func(viewId int) string {
+		args := &NewViewArgs{}
+		args.ViewId = viewId
+		signMessage(c.serverKeys[faulty].PrivateKey, args)
+		reply := &DefaultReply{}
+		pf.NewView(args, reply)
+		return reply.Err
+	}
+
+	if err := newView(faulty + 4*1000); err == "" {
+		t.Error("new-view message accepted outside a view change")
+	}
+	pf.mu.Lock()
+	pf.sendViewChange(1)
+	pf.mu.Unlock()
+	for _, viewId := range []int{faulty, faulty + 4*1000} {
+		if err := newView(viewId); err == "" {
+			t.Errorf("invalid new-view message for view %d accepted", viewId)
+		}
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.viewId != 0 || !pf.viewChanging || pf.nextViewId != 1 {
+		t.Errorf("replica in view %d moving to view %d, expected to move to view 1", pf.viewId, pf.nextViewId)
+	}
+}
+
+// TestFuturePreprepareFaultyReplica buffers a pre-prepare of the current
+// view above the high watermark. A faulty replica signs pre-prepares for
+// the same sequence id in views it leads, they must not replace it, and
+// only the one for the view the replica is moving to is buffered.
+func TestFuturePreprepareFaultyReplica(t *testing.T) {
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 20
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, false)
+	faulty := 1
+	pf := c.replicas[2]
+	seqId := config.LogWindow + 1
+	preprepare := func(viewId int, key ed25519.PrivateKey) (*PrePrepareAgrs, string) {
+		args := &PrePrepareAgrs{}
+		args.ViewId = viewId
+		args.SeqId = seqId
+		args.Digest = batchDigest(nil)
+		signMessage(key, args)
+		reply := &DefaultReply{}
+		pf.Preprepare(args, reply)
+		return args, reply.Err
+	}
+
+	buffered, err := preprepare(0, c.serverKeys[0].PrivateKey)
+	if err != "" {
+		t.Fatal(err)
+	}
+	if _, err := preprepare(faulty+4, c.serverKeys[faulty].PrivateKey); err == "" {
+		t.Error("pre-prepare of a later view buffered outside a view change")
+	}
+	pf.mu.Lock()
+	pf.sendViewChange(faulty)
+	pf.mu.Unlock()
+	if _, err := preprepare(faulty, c.serverKeys[faulty].PrivateKey); err != "" {
+		t.Errorf("pre-prepare of the next view rejected: %s", err)
+	}
+	if _, err := preprepare(faulty+4, c.serverKeys[faulty].PrivateKey); err == "" {
+		t.Error("pre-prepare of a view the replica is not moving to buffered")
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.futurePreprepares[0][seqId] != buffered {
+		t.Error("buffered pre-prepare of the current view replaced")
+	}
+	if len(pf.futurePreprepares) != 2 {
+		t.Errorf("pre-prepares of %d views buffered, expected 2", len(pf.futurePreprepares))
+	}
+}
+
+// TestWatermarksFaultyReplica sends prepares and commits outside the log
+// window and view-change messages for a hundred views from a faulty
+// replica. The replica keeps none of the prepares and commits and only the
+// view-change message for the highest view.
+func TestWatermarksFaultyReplica(t *testing.T) {
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 20
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, false)
+	faulty := 1
+	key := c.serverKeys[faulty].PrivateKey
+	pf := c.replicas[2]
+
+	for _, seqId := range []int{0, config.LogWindow + 1, 1000 * config.LogWindow} {
+		prepare := &PrepareArgs{}
+		prepare.SeqId = seqId
+		prepare.ReplicaId = faulty
+		signMessage(key, prepare)
+		reply := &DefaultReply{}
+		pf.Prepare(prepare, reply)
+		if reply.Err == "" {
+			t.Errorf("prepare for sequence id %d accepted", seqId)
+		}
+		commit := &CommitArgs{}
+		commit.SeqId = seqId
+		commit.ReplicaId = faulty
+		signMessage(key, commit)
+		reply = &DefaultReply{}
+		pf.Commit(commit, reply)
+		if reply.Err == "" {
+			t.Errorf("commit for sequence id %d accepted", seqId)
+		}
+	}
+	const views = 100
+	for viewId := 1; viewId <= views; viewId++ {
+		viewChange := &ViewChangeArgs{}
+		viewChange.ViewId = viewId
+		viewChange.ReplicaId = faulty
+		signMessage(key, viewChange)
+		pf.ViewChange(viewChange, &DefaultReply{})
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if len(pf.prepares) != 0 || len(pf.commits) != 0 {
+		t.Errorf("prepares for %d and commits for %d sequence ids kept", len(pf.prepares), len(pf.commits))
+	}
+	if len(pf.viewChanges) != 1 || pf.viewChanges[views][faulty] == nil {
+		t.Errorf("view-change messages for %d views kept, expected only view %d", len(pf.viewChanges), views)
+	}
+}
+
+// faultyPeer answers the state transfer of a replica with the entries it
+// was given.
+type faultyPeer struct {
+	entries []LogEntry
+}
+
+func (p *faultyPeer) FetchLog(args *FetchLogArgs, reply *FetchLogReply) error {
+	reply.Entries = p.entries
+	return nil
+}
+
+// TestCollectLogFaultyPeer fetches the log while a faulty peer returns a
+// forged entry f+1 times in one reply. Its copies count as one vote, so the
+// entry is neither collected nor executed.
+func TestCollectLogFaultyPeer(t *testing.T) {
+	config := &Config{}
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, false)
+	request := RequestArgs{}
+	request.Operation = []byte("forged")
+	request.Timestamp = 1
+	forged := LogEntry{}
+	forged.SeqId = 1
+	forged.Requests = []RequestArgs{request}
+	peer := &faultyPeer{}
+	peer.entries = []LogEntry{forged, forged}
+	c.replace(3, peer)
+
+	pf := c.replicas[1]
+	entries := pf.collectLog(0)
+	if len(entries) != 0 {
+		t.Errorf("%d forged entries collected", len(entries))
+	}
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.installLog(entries)
+	if applied := pf.sm.(*EchoStateMachine).Applied; pf.lastExecuted != 0 || applied != 0 {
+		t.Errorf("replica executed %d entries and applied %d operations", pf.lastExecuted, applied)
+	}
+}
+
+// TestReplayForgedRecords logs pre-prepares and commits signed by a
+// faulty replica in the name of others and a view far ahead, then reboots
+// the replica the way a proactive recovery does. The recovery replay keeps
+// only the records that verify and ignores the logged view, it is taken
+// from the peers instead.
+func TestReplayForgedRecords(t *testing.T) {
+	config := &Config{}
+	c := newTestCluster(t, 4, 1, config, SignatureAuthMode, true)
+	pf := c.replicas[1]
+	forger := c.serverKeys[3].PrivateKey
+
+	preprepare := func(seqId int, key ed25519.PrivateKey) *Record {
+		record := &Record{}
+		record.Type = PreprepareRecord
+		record.Preprepare = &PrePrepareAgrs{}
+		record.Preprepare.SeqId = seqId
+		record.Preprepare.Digest = batchDigest(nil)
+		signMessage(key, record.Preprepare)
+		return record
+	}
+	records := []*Record{preprepare(1, c.serverKeys[0].PrivateKey), preprepare(2, forger)}
+	for replicaId := 0; replicaId < 4; replicaId++ {
+		record := &Record{}
+		record.Type = CommitRecord
+		record.Commit = &CommitArgs{}
+		record.Commit.SeqId = 1
+		record.Commit.Digest = batchDigest(nil)
+		record.Commit.ReplicaId = replicaId
+		signMessage(forger, record.Commit)
+		records = append(records, record)
+	}
+	metadata := &Record{}
+	metadata.Type = MetadataRecord
+	metadata.Metadata = &Metadata{}
+	metadata.Metadata.ViewId = 4 * 1000
+	records = append(records, metadata)
+	for _, record := range records {
+		err := c.storages[1].Append(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.reboot()
+	if _, ok := pf.logs[1]; !ok {
+		t.Error("logged preprepare of the primary dropped")
+	}
+	if _, ok := pf.logs[2]; ok {
+		t.Error("forged preprepare replayed")
+	}
+	if len(pf.commits[1]) != 1 {
+		t.Errorf("%d commits replayed, only the one of the forger verifies", len(pf.commits[1]))
+	}
+	if pf.lastExecuted != 0 || pf.viewId != 0 {
+		t.Errorf("replica executed %d entries in view %d after replaying forged records", pf.lastExecuted, pf.viewId)
+	}
+}
+
+// requestRecorder plays a primary that passes the requests relayed to it
+// to a channel.
+type requestRecorder struct {
+	requests chan *RequestArgs
+}
+
+func (r *requestRecorder) Request(args *RequestArgs, reply *DefaultReply) error {
+	r.requests <- args
+	return nil
+}
+
+// TestRequestRetransmission sends a request to a backup twice and a
+// request of another client with the same timestamp. The retransmission
+// is relayed to the primary again without restarting the timer, and the
+// requests of the two clients are timed separately.
+func TestRequestRetransmission(t *testing.T) {
+	config := &Config{}
+	c := newTestCluster(t, 4, 2, config, SignatureAuthMode, false)
+	primary := &requestRecorder{}
+	primary.requests = make(chan *RequestArgs, 3)
+	c.replace(0, primary)
+	pf := c.replicas[1]
+
+	request := func(clientId int) *RequestArgs {
+		args := &RequestArgs{}
+		args.ClientId = clientId
+		args.Operation = []byte("op")
+		args.Timestamp = 1
+		c.clients[clientId].auth.authenticate(args)
+		err := pf.Request(args, &DefaultReply{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return args
+	}
+	request(0)
+	pf.mu.Lock()
+	timer := pf.requestTimer[requestKey{0, 1}]
+	pf.mu.Unlock()
+	request(0)
+	request(1)
+
+	for relayed := 0; relayed < 3; relayed++ {
+		select {
+		case <-primary.requests:
+		case <-time.After(testTimeout):
+			t.Fatalf("%d of 3 requests relayed to the primary", relayed)
+		}
+	}
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if timer == nil || pf.requestTimer[requestKey{0, 1}] != timer {
+		t.Error("retransmission restarted the request timer")
+	}
+	if len(pf.requestTimer) != 2 {
+		t.Errorf("%d request timers for the requests of 2 clients", len(pf.requestTimer))
+	}
+}
+
+// TestMacRecovery orders requests in MAC mode before and after a replica
+// recovers. The other replicas must install its fresh session keys, the
+// messages it sends afterwards are only accepted with them.
+func TestMacRecovery(t *testing.T) {
+	config := &Config{}
+	config.CheckpointInterval = 10
+	config.LogWindow = 20
+	c := newTestCluster(t, 4, 1, config, MacAuthMode, true)
+	recovering := 1
+
+	requests := 0
+	for ; requests < 15; requests++ {
+		err := c.request(0, fmt.Sprintf("op %d", requests))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.replicas[recovering].recover()
+	for ; requests < 45; requests++ {
+		err := c.request(0, fmt.Sprintf("op %d", requests))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests = c.converge(requests)
+	for id, pf := range c.replicas {
+		pf.mu.Lock()
+		applied := pf.sm.(*EchoStateMachine).Applied
+		pf.mu.Unlock()
+		if applied != requests {
+			t.Errorf("replica %d applied %d operations, %d requests were sent", id, applied, requests)
+		}
+		if id == recovering {
+			continue
+		}
+		ma := pf.auth.(*macAuthenticator)
+		ma.mu.Lock()
+		epoch := ma.epochs[recovering]
+		ma.mu.Unlock()
+		if epoch == 0 {
+			t.Errorf("replica %d did not install the keys of the recovered replica", id)
+		}
+	}
+}
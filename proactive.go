@@ -0,0 +1,196 @@
+package pbft
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// recoveryLoop recovers the replica every recovery interval. Replica i
+// recovers at i/n of the interval, so the replicas recover one after the
+// other and fewer than f are recovering at any time as long as a recovery
+// takes less than interval/n.
+func (pf *Pbft) recoveryLoop() {
+	interval := time.Duration(pf.recoveryInterval) * time.Millisecond
+	time.Sleep(interval + interval*time.Duration(pf.me)/time.Duration(pf.n))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pf.recover()
+		<-ticker.C
+	}
+}
+
+// recover reboots the replica from a clean state. It refreshes its MAC
+// session keys first, so session keys an attacker learned are useless
+// afterwards, then drops everything it holds in memory, the malicious
+// behaviors included, and restores the logged messages that verify. The
+// view and the stable checkpoint are taken from the peers, the state after
+// a checkpoint is only accepted with a valid proof. The recovery is
+// complete once a checkpoint at or above the high watermark the peers had
+// when it started becomes stable.
+func (pf *Pbft) recover() {
+	pf.mu.Lock()
+	pf.debugPrint(fmt.Sprintf("Proactive recovery: View[%d] checkpoint %d executed %d\n", pf.viewId, pf.lastCheckpointSeqId, pf.lastExecuted))
+	pf.refreshKeys()
+	pf.reboot()
+	pf.mu.Unlock()
+
+	replies := pf.queryStable()
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.installStable(replies)
+}
+
+// refreshKeys makes the replica accept only messages authenticated with
+// fresh MAC session keys and announces them to the replicas and clients in
+// a new-key message signed with its Ed25519 key. The Ed25519 key itself is
+// never refreshed, it is assumed to be out of reach of an attacker, like
+// the key in the secure coprocessor of the original protocol. Refreshing
+// it would invalidate the checkpoint proofs and certificates signed with
+// it. So in signature mode a recovery refreshes no keys at all.
+func (pf *Pbft) refreshKeys() {
+	key := pf.auth.refreshKeys()
+	if key == nil {
+		pf.debugPrint("Signature mode: no session keys to refresh\n")
+		return
+	}
+
+	newKeyArgs := &NewKeyArgs{}
+	newKeyArgs.ReplicaId = pf.me
+	newKeyArgs.Epoch = time.Now().UnixNano()
+	newKeyArgs.Key = key
+	pf.sign(newKeyArgs)
+	pf.newKey = newKeyArgs
+	pf.broadcast("NewKey", newKeyArgs)
+	for _, client := range pf.clients {
+		c := client
+		go c.Call("Client.NewKey", newKeyArgs, &DefaultReply{})
+	}
+}
+
+// sendNewKey sends the last new-key message to a node whose message failed
+// authentication. It may have missed the message or lost the keys in a
+// restart.
+func (pf *Pbft) sendNewKey(peer *peerWrapper, rpcname string) {
+	if pf.newKey == nil {
+		return
+	}
+	go peer.Call(rpcname, pf.newKey, &DefaultReply{})
+}
+
+func (pf *Pbft) cancelTimers() {
+	for _, timer := range pf.requestTimer {
+		timer.Cancel()
+	}
+	if pf.viewChangeTimer != nil {
+		pf.viewChangeTimer.Cancel()
+	}
+	if pf.gapTimer != nil {
+		pf.gapTimer.Cancel()
+	}
+	if pf.batchTimer != nil {
+		pf.batchTimer.Cancel()
+	}
+}
+
+func (pf *Pbft) reboot() {
+	pf.cancelTimers()
+	pf.reset()
+	if pf.storage == nil {
+		return
+	}
+	err := pf.replayStorage(true)
+	if err != nil {
+		log.Fatal("storage error: ", err)
+	}
+}
+
+// queryStable asks the peers for their view and their last stable
+// checkpoint.
+func (pf *Pbft) queryStable() []*QueryStableReply {
+	args := &QueryStableArgs{}
+	args.ReplicaId = pf.me
+	replies := make([]*QueryStableReply, 0)
+	for id, peer := range pf.servers {
+		if id == pf.me {
+			continue
+		}
+
+		reply := &QueryStableReply{}
+		err := peer.Call("Pbft.QueryStable", args, reply)
+		if err != nil || reply.Err != "" {
+			continue
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// installStable moves the replica to the view f+1 peers are at least in,
+// so at least one correct replica is, and to the highest stable checkpoint
+// with a valid proof. A replica that has not executed up to it fetches the
+// state. A primary without storage starts a view change.
+func (pf *Pbft) installStable(replies []*QueryStableReply) {
+	views := make([]int, 0)
+	var latest *QueryStableReply
+	for _, reply := range replies {
+		views = append(views, reply.ViewId)
+		if latest != nil && reply.SeqId <= latest.SeqId {
+			continue
+		}
+		if pf.verifyCheckpointProof(reply.SeqId, reply.Digest, reply.Proof) {
+			latest = reply
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(views)))
+	if len(views) > pf.f {
+		viewId := views[pf.f]
+		if viewId > pf.viewId && (!pf.viewChanging || viewId >= pf.nextViewId) {
+			pf.adoptView(viewId)
+		}
+	}
+
+	if latest != nil && latest.SeqId > pf.lastCheckpointSeqId {
+		if pf.seqId < latest.SeqId {
+			pf.seqId = latest.SeqId
+		}
+		pf.stabilizeCheckpoint(latest.SeqId, latest.Digest, latest.Proof)
+	}
+	if pf.lastExecuted < pf.lastCheckpointSeqId {
+		pf.fetchState(pf.lastCheckpointSeqId)
+	}
+	if pf.storage == nil && pf.isPrimary() && !pf.viewChanging {
+		// the sequence ids it assigned in the view are lost, the view is
+		// given up
+		pf.sendViewChange(pf.viewId + 1)
+	}
+	pf.recoverySeqId = pf.lastCheckpointSeqId + pf.logWindow
+	pf.debugPrint(fmt.Sprintf("Recovering: View[%d] checkpoint %d, complete at checkpoint %d\n", pf.viewId, pf.lastCheckpointSeqId, pf.recoverySeqId))
+}
+
+// adoptView enters a view the replica missed the new-view message of. The
+// entries of previous views that did not commit are dropped, the entries
+// of the view it logged are kept and the committed entries it lacks are
+// fetched once the gap is noticed.
+func (pf *Pbft) adoptView(viewId int) {
+	pf.debugPrint(fmt.Sprintf("Adopt View[%d]\n", viewId))
+	pf.enterView(viewId)
+	if pf.rollbackTentative() {
+		pf.executeCommitted()
+	}
+	for seqId, logEntry := range pf.logs {
+		if logEntry.Phase != PbftPhasecommitted && logEntry.ViewId < viewId {
+			delete(pf.logs, seqId)
+			continue
+		}
+		// a primary must not assign the sequence ids of the view again
+		if logEntry.ViewId == viewId && seqId > pf.seqId {
+			pf.seqId = seqId
+		}
+	}
+	pf.persistMetadata()
+}
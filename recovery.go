@@ -0,0 +1,296 @@
+package pbft
+
+import (
+	"fmt"
+	"log"
+)
+
+// persist appends a record to the storage before the replica acts on it.
+// A replica that can not log its promises must not make them, so an
+// error stops it.
+func (pf *Pbft) persist(record *Record) {
+	if pf.storage == nil {
+		return
+	}
+	err := pf.storage.Append(record)
+	if err != nil {
+		log.Fatal("storage error: ", err)
+	}
+}
+
+func (pf *Pbft) persistPreprepare(args *PrePrepareAgrs) {
+	record := &Record{}
+	record.Type = PreprepareRecord
+	record.Preprepare = args
+	pf.persist(record)
+}
+
+func (pf *Pbft) persistMetadata() {
+	record := &Record{}
+	record.Type = MetadataRecord
+	record.Metadata = &Metadata{}
+	record.Metadata.ViewId = pf.viewId
+	record.Metadata.NextViewId = pf.nextViewId
+	record.Metadata.ViewChanging = pf.viewChanging
+	record.Metadata.SeqId = pf.seqId
+	pf.persist(record)
+}
+
+// saveSnapshot stores the snapshot of a stable checkpoint if the replica
+// has executed up to it. A restarted replica without it fetches the state
+// from its peers, so a failure is not fatal.
+func (pf *Pbft) saveSnapshot(seqId int) {
+	snapshot, ok := pf.snapshots[seqId]
+	if pf.storage == nil || !ok {
+		return
+	}
+	err := pf.storage.SaveSnapshot(seqId, snapshot)
+	if err != nil {
+		pf.debugPrint(fmt.Sprintf("Saving snapshot of checkpoint %d failed: %s\n", seqId, err))
+	}
+}
+
+// persistCheckpoint saves the snapshot of a checkpoint that became stable
+// before the checkpoint itself, so a restarted replica finds the snapshot
+// of its last stable checkpoint unless it has not executed up to it.
+func (pf *Pbft) persistCheckpoint(seqId int, digest string, proof []CheckpointArgs) {
+	if pf.storage == nil {
+		return
+	}
+	pf.saveSnapshot(seqId)
+
+	record := &Record{}
+	record.Type = CheckpointRecord
+	record.Checkpoint = &StableCheckpoint{}
+	record.Checkpoint.SeqId = seqId
+	record.Checkpoint.Digest = digest
+	record.Checkpoint.Proof = proof
+	pf.persist(record)
+}
+
+// compactStorage replaces the log by the records the replica still needs
+// after garbage collection: its view, the stable checkpoint and the
+// entries, prepares and commits above it. Replaying them restores the
+// same state as replaying the full log.
+func (pf *Pbft) compactStorage() {
+	if pf.storage == nil {
+		return
+	}
+
+	records := make([]*Record, 0)
+	metadata := &Record{}
+	metadata.Type = MetadataRecord
+	metadata.Metadata = &Metadata{}
+	metadata.Metadata.ViewId = pf.viewId
+	metadata.Metadata.NextViewId = pf.nextViewId
+	metadata.Metadata.ViewChanging = pf.viewChanging
+	metadata.Metadata.SeqId = pf.seqId
+	records = append(records, metadata)
+
+	checkpoint := &Record{}
+	checkpoint.Type = CheckpointRecord
+	checkpoint.Checkpoint = &StableCheckpoint{}
+	checkpoint.Checkpoint.SeqId = pf.lastCheckpointSeqId
+	checkpoint.Checkpoint.Digest = pf.lastCheckpointDigest
+	checkpoint.Checkpoint.Proof = pf.lastCheckpointProof
+	records = append(records, checkpoint)
+
+	for seqId := pf.lastCheckpointSeqId + 1; seqId <= pf.lastCheckpointSeqId+2*pf.logWindow; seqId++ {
+		if logEntry, ok := pf.logs[seqId]; ok {
+			record := &Record{}
+			record.Type = PreprepareRecord
+			record.Preprepare = &PrePrepareAgrs{}
+			record.Preprepare.ViewId = logEntry.ViewId
+			record.Preprepare.SeqId = seqId
+			record.Preprepare.Digest = logEntry.Digest
+			record.Preprepare.Requests = logEntry.Requests
+			record.Preprepare.Signature = logEntry.Signature
+			records = append(records, record)
+		}
+		for _, prepare := range pf.prepares[seqId] {
+			record := &Record{}
+			record.Type = PrepareRecord
+			record.Prepare = prepare
+			records = append(records, record)
+		}
+		for _, commit := range pf.commits[seqId] {
+			record := &Record{}
+			record.Type = CommitRecord
+			record.Commit = commit
+			records = append(records, record)
+		}
+	}
+
+	err := pf.storage.Compact(records)
+	if err != nil {
+		log.Fatal("storage error: ", err)
+	}
+}
+
+func (pf *Pbft) restore() error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	return pf.replayStorage(false)
+}
+
+// replayStorage replays the storage, so a restarted replica is back in its
+// view with the entries, prepares and commits it had logged. The state
+// machine and the last replies are restored from the snapshot of the
+// stable checkpoint and the committed entries after it are executed
+// again. Without a matching snapshot the state is fetched from the peers
+// once the gap is noticed. Every record is checked like the message it
+// holds, records an attacker could have written are dropped. A recovering
+// replica takes its view from the peers, the unsigned view it logged is
+// ignored.
+func (pf *Pbft) replayStorage(recovering bool) error {
+	records := 0
+	err := pf.storage.Replay(func(record *Record) {
+		if pf.replayRecord(record, recovering) {
+			records++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if records == 0 {
+		return nil
+	}
+
+	seqId, snapshot, err := pf.storage.LoadSnapshot()
+	if err != nil {
+		return err
+	}
+	if snapshot != nil && seqId > 0 && seqId == pf.lastCheckpointSeqId {
+		err = pf.restoreState(snapshot)
+		if err == nil && pf.stateDigest() == pf.lastCheckpointDigest {
+			pf.snapshots[seqId] = snapshot
+			pf.lastExecuted = seqId
+		} else {
+			pf.debugPrint(fmt.Sprintf("Stored snapshot does not restore to checkpoint %d\n", seqId))
+			pf.sm.Restore(pf.initialSnapshot)
+			pf.lastReplies = make(map[int]*ReplyArgs)
+		}
+	}
+
+	pf.debugPrint(fmt.Sprintf("Restored %d records: View[%d] SeqId[%d] checkpoint %d executed %d\n", records, pf.viewId, pf.seqId, pf.lastCheckpointSeqId, pf.lastExecuted))
+	if pf.maxCommitted < pf.lastCheckpointSeqId {
+		pf.maxCommitted = pf.lastCheckpointSeqId
+	}
+	pf.executeCommitted()
+	if pf.viewChanging {
+		pf.sendViewChange(pf.nextViewId)
+	}
+	return nil
+}
+
+// replayRecord applies a logged record to the in-memory state the way it
+// was applied when it was logged, without sending anything. It returns
+// false if the record was dropped.
+func (pf *Pbft) replayRecord(record *Record, recovering bool) bool {
+	switch {
+	case record.Type == PreprepareRecord && record.Preprepare != nil:
+		args := record.Preprepare
+		if args.SeqId <= pf.lastCheckpointSeqId {
+			return true
+		}
+		if batchDigest(args.Requests) != args.Digest || !pf.verifyReplica(args.ViewId%pf.n, args) {
+			pf.debugPrint(fmt.Sprintf("Dropped logged PrePrepare[ViewId %d, SeqId %d]\n", args.ViewId, args.SeqId))
+			return false
+		}
+		logEntry := &LogEntry{}
+		logEntry.SeqId = args.SeqId
+		logEntry.Digest = args.Digest
+		logEntry.Requests = args.Requests
+		logEntry.Signature = args.Signature
+		logEntry.ViewId = args.ViewId
+		logEntry.Phase = PbftPhasePrepare
+		pf.logs[args.SeqId] = logEntry
+		if args.ViewId == pf.viewId && args.SeqId > pf.seqId {
+			pf.seqId = args.SeqId
+		}
+		pf.replayPhase(args.SeqId)
+	case record.Type == PrepareRecord && record.Prepare != nil:
+		if !pf.verifyLogged(record.Prepare.ReplicaId, record.Prepare, recovering) {
+			pf.debugPrint(fmt.Sprintf("Dropped logged Prepare[ViewId %d, SeqId %d, Rep %d]\n", record.Prepare.ViewId, record.Prepare.SeqId, record.Prepare.ReplicaId))
+			return false
+		}
+		pf.storePrepare(record.Prepare)
+		pf.replayPhase(record.Prepare.SeqId)
+	case record.Type == CommitRecord && record.Commit != nil:
+		if !pf.verifyLogged(record.Commit.ReplicaId, record.Commit, recovering) {
+			pf.debugPrint(fmt.Sprintf("Dropped logged Commit[ViewId %d, SeqId %d, Rep %d]\n", record.Commit.ViewId, record.Commit.SeqId, record.Commit.ReplicaId))
+			return false
+		}
+		pf.storeCommit(record.Commit)
+		pf.replayPhase(record.Commit.SeqId)
+	case record.Type == CheckpointRecord && record.Checkpoint != nil:
+		checkpoint := record.Checkpoint
+		if checkpoint.SeqId <= pf.lastCheckpointSeqId {
+			return true
+		}
+		if !pf.verifyCheckpointProof(checkpoint.SeqId, checkpoint.Digest, checkpoint.Proof) {
+			pf.debugPrint(fmt.Sprintf("Dropped logged checkpoint %d without a valid proof\n", checkpoint.SeqId))
+			return false
+		}
+		pf.lastCheckpointSeqId = checkpoint.SeqId
+		pf.lastCheckpointDigest = checkpoint.Digest
+		pf.lastCheckpointProof = checkpoint.Proof
+		pf.garbageCollect(checkpoint.SeqId)
+		if pf.seqId < checkpoint.SeqId {
+			pf.seqId = checkpoint.SeqId
+		}
+	case record.Type == MetadataRecord && record.Metadata != nil:
+		if recovering {
+			return false
+		}
+		metadata := record.Metadata
+		if metadata.ViewId > pf.viewId && !metadata.ViewChanging {
+			// the new view was installed, the uncommitted entries of the
+			// previous views were dropped
+			for seqId, logEntry := range pf.logs {
+				if logEntry.Phase != PbftPhasecommitted {
+					delete(pf.logs, seqId)
+				}
+			}
+		}
+		pf.viewId = metadata.ViewId
+		pf.nextViewId = metadata.NextViewId
+		pf.viewChanging = metadata.ViewChanging
+		pf.seqId = metadata.SeqId
+	}
+	return true
+}
+
+// verifyLogged checks the signature of a logged prepare or commit. In MAC
+// mode the commits and the prepares of the primary are not signed, their
+// MACs were only valid for the keys of the time. They are trusted when the
+// replica restarts after a crash and dropped when it recovers, it fetches
+// what committed meanwhile from its peers.
+func (pf *Pbft) verifyLogged(replicaId int, msg signedMessage, recovering bool) bool {
+	if pf.authMode == MacAuthMode && msg.signature() == nil {
+		return !recovering
+	}
+	return pf.verifyReplica(replicaId, msg)
+}
+
+// replayPhase moves a replayed entry through the prepare and commit phases
+// with the prepares and commits replayed so far. They are only logged
+// while the replica is in the view of the entry, so unlike at run time
+// the current view is not checked, a compacted log starts in the latest
+// view.
+func (pf *Pbft) replayPhase(seqId int) {
+	logEntry, ok := pf.logs[seqId]
+	if !ok {
+		return
+	}
+
+	if logEntry.Phase == PbftPhasePrepare && len(pf.matchingPrepares(logEntry)) > 2*pf.f {
+		logEntry.Phase = PbftPhasecommit
+	}
+	if logEntry.Phase == PbftPhasecommit && pf.matchingCommits(logEntry) > 2*pf.f {
+		logEntry.Phase = PbftPhasecommitted
+		if seqId > pf.maxCommitted {
+			pf.maxCommitted = seqId
+		}
+	}
+}
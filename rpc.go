@@ -9,103 +9,151 @@ func (pf *Pbft) Request(args *RequestArgs, reply *DefaultReply) error {
 	defer pf.mu.Unlock()
 
 	pf.debugPrint(fmt.Sprintf("Recieved Request[Time %d Cmd %s] from Client[%d]\n", args.Timestamp, args.Operation, args.ClientId))
-	if seqId := pf.getReplyFromLog(args); seqId != 0 {
-		c := pf.clients[args.ClientId]
-		replyArgs := pf.logs[seqId].Reply
-		if replyArgs.Timestamp != 0 {
-			defaultReply := DefaultReply{}
-			go c.Call("Client.Reply", &replyArgs, &defaultReply)
-		}
+	if !pf.authClient(args.ClientId, args) {
+		reply.Err = "Invalid authenticator"
 		return nil
 	}
 
-	pf.newRequestTimer(args.Timestamp)
+	if args.ReadOnly {
+		pf.executeReadOnly(args)
+		return nil
+	}
 
-	if pf.isPrimary() {
-		// insert requset to log
-		pf.seqId++
+	if lastReply, ok := pf.lastReplies[args.ClientId]; ok && args.Timestamp <= lastReply.Timestamp {
+		// resend the last reply, requests older than it are dropped
+		if args.Timestamp == lastReply.Timestamp {
+			replyArgs := &ReplyArgs{}
+			*replyArgs = *lastReply
+			pf.replyClient(args.ClientId, replyArgs)
+		}
+		return nil
+	}
 
-		prepreareArgs := &PrePrepareAgrs{}
-		prepreareArgs.ViewId = pf.viewId
-		prepreareArgs.SeqId = pf.seqId
-		prepreareArgs.Request = *args
-		// todo: digest
-		prepreareArgs.Digest = args.Operation.(string)
-		pf.broadcast("Preprepare", prepreareArgs)
+	if pf.viewChanging {
+		// the client retransmits it
+		reply.Err = "View change in progress"
+		return nil
+	}
 
-		newLog := &LogEntry{}
-		newLog.SeqId = prepreareArgs.SeqId
-		newLog.Request = prepreareArgs.Request
-		newLog.ViewId = pf.viewId
-		newLog.Phase = PbftPhasePrepare
-		pf.logs[prepreareArgs.SeqId] = newLog
+	// retransmissions do not restart the timer, but are forwarded again
+	// in case the primary missed the request
+	key := requestKey{args.ClientId, args.Timestamp}
+	if pf.requestTimer[key] == nil {
+		pf.newRequestTimer(key)
+	}
 
+	if seqId := pf.findRequestInLog(args); seqId != 0 || pf.isPending(args) {
+		// already ordered, wait for it to execute
+		return nil
+	}
+
+	if pf.isPrimary() {
+		if pf.seqId >= pf.highWatermark() {
+			// log window is full, it is proposed once a checkpoint becomes stable
+			pf.heldBackRequests++
+		}
+		pf.pendingRequests = append(pf.pendingRequests, *args)
+		pf.proposePending(false)
 		return nil
 	} else {
 		// relay to primary
-		// n := len(pf.servers)
-		// primaryId := pf.viewId % n
-		// go pf.servers[primaryId].Call("Pbft.Request", args, reply)
+		primaryId := pf.viewId % pf.n
+		go pf.servers[primaryId].Call("Pbft.Request", args, &DefaultReply{})
 		return nil
 	}
-	return nil
 }
 
 func (pf *Pbft) Preprepare(args *PrePrepareAgrs, reply *DefaultReply) error {
 	pf.mu.Lock()
 	defer pf.mu.Unlock()
-	if pf.viewId != args.ViewId {
+	if args.ViewId < pf.viewId {
 		reply.Err = "Wrong viewId"
 		return nil
 	}
+	if args.ViewId == pf.viewId && pf.viewChanging {
+		reply.Err = "View change in progress"
+		return nil
+	}
+	if args.ViewId > pf.viewId && (!pf.viewChanging || args.ViewId != pf.nextViewId) {
+		// every replica is the primary of some view, only the view the
+		// replica is moving to is buffered
+		reply.Err = "Not waiting for view"
+		return nil
+	}
 
 	pf.debugPrint(fmt.Sprintf("Received Preprepare[Seq %d, View %d, Digest %s]\n", args.SeqId, args.ViewId, args.Digest))
+	if !pf.verifyReplica(args.ViewId%pf.n, args) {
+		reply.Err = "Invalid signature"
+		return nil
+	}
+	for i := range args.Requests {
+		request := &args.Requests[i]
+		if !pf.authClient(request.ClientId, request) {
+			reply.Err = "Invalid request authenticator"
+			return nil
+		}
+	}
 
-	lowSeqLevel := pf.lastCheckpointSeqId
-	highSeqLevel := pf.lastCheckpointSeqId + 2*CheckPointSequenceInterval
-	if args.SeqId <= lowSeqLevel || args.SeqId > highSeqLevel {
-		pf.debugPrint(fmt.Sprintf("Preprepare msg is invalid: invalid sequence id %d.\n"))
+	if batchDigest(args.Requests) != args.Digest {
+		pf.debugPrint(fmt.Sprintf("Preprepare msg is invalid: digest mismatch at sequence id %d.\n", args.SeqId))
+		reply.Err = "Invalid digest"
 		return nil
 	}
 
-	// accept PrePrepare Msg
-	var newLog *LogEntry
-	if pf.isPrimary() {
-		newLog = pf.logs[args.SeqId]
-	} else {
-		newLog = &LogEntry{}
-		newLog.SeqId = args.SeqId
-		newLog.Request = args.Request
-		newLog.ViewId = pf.viewId
-		newLog.Phase = PbftPhasePrepare
-		pf.logs[args.SeqId] = newLog
+	if args.SeqId <= pf.lastCheckpointSeqId || args.SeqId > pf.highWatermark()+pf.logWindow {
+		pf.debugPrint(fmt.Sprintf("Preprepare msg is invalid: invalid sequence id %d.\n", args.SeqId))
+		return nil
 	}
 
-	// save to prepares
-	pf.savePrepare(args.SeqId, pf.me, args.Digest)
-	pf.processPrepares(args.SeqId)
+	if args.ViewId > pf.viewId || args.SeqId > pf.highWatermark() {
+		// the primary may see the next checkpoint become stable or enter
+		// its view first
+		if !pf.saveFuturePreprepare(args) {
+			reply.Err = "Conflicting preprepare"
+		}
+		return nil
+	}
 
-	// broadcast Prepare
-	prepareArgs := &PrepareArgs{}
-	prepareArgs.SeqId = newLog.SeqId
-	prepareArgs.ReplicaId = pf.me
-	prepareArgs.ViewId = pf.viewId
-	prepareArgs.Digest = args.Digest
-	pf.broadcast("Prepare", prepareArgs)
+	if logEntry, ok := pf.logs[args.SeqId]; ok && logEntry.ViewId == args.ViewId && logEntry.Digest != args.Digest {
+		reply.Err = "Conflicting preprepare"
+		return nil
+	}
+
+	pf.acceptPreprepare(args)
 	return nil
 }
 
+// Prepare and commit messages are only accepted within the log window, a
+// faulty replica can not make the replica keep and log more. Those of the
+// view the replica is moving to are saved, they are counted once it enters
+// the view.
 func (pf *Pbft) Prepare(args *PrepareArgs, reply *DefaultReply) error {
 	pf.mu.Lock()
 	defer pf.mu.Unlock()
-	if args.ViewId != pf.viewId {
+	if args.ViewId < pf.viewId {
 		reply.Err = "Wrong viewId"
 		return nil
 	}
+	if args.ViewId == pf.viewId && pf.viewChanging {
+		reply.Err = "View change in progress"
+		return nil
+	}
+	if args.ViewId > pf.viewId && (!pf.viewChanging || args.ViewId != pf.nextViewId) {
+		reply.Err = "Not waiting for view"
+		return nil
+	}
+	if args.SeqId <= pf.lastCheckpointSeqId || args.SeqId > pf.highWatermark() {
+		reply.Err = "Invalid sequence id"
+		return nil
+	}
 
 	pf.debugPrint(fmt.Sprintf("Received Prepare[Seq %d, View %d, Rep %d, Digest %s]\n", args.SeqId, args.ViewId, args.ReplicaId, args.Digest))
+	if !pf.authReplica(args.ReplicaId, args) {
+		reply.Err = "Invalid authenticator"
+		return nil
+	}
 
-	pf.savePrepare(args.SeqId, args.ReplicaId, args.Digest)
+	pf.savePrepare(args)
 	pf.processPrepares(args.SeqId)
 	return nil
 }
@@ -113,14 +161,30 @@ func (pf *Pbft) Prepare(args *PrepareArgs, reply *DefaultReply) error {
 func (pf *Pbft) Commit(args *CommitArgs, reply *DefaultReply) error {
 	pf.mu.Lock()
 	defer pf.mu.Unlock()
-	if args.ViewId != pf.viewId {
+	if args.ViewId < pf.viewId {
 		reply.Err = "Wrong viewId"
 		return nil
 	}
+	if args.ViewId == pf.viewId && pf.viewChanging {
+		reply.Err = "View change in progress"
+		return nil
+	}
+	if args.ViewId > pf.viewId && (!pf.viewChanging || args.ViewId != pf.nextViewId) {
+		reply.Err = "Not waiting for view"
+		return nil
+	}
+	if args.SeqId <= pf.lastCheckpointSeqId || args.SeqId > pf.highWatermark() {
+		reply.Err = "Invalid sequence id"
+		return nil
+	}
 
 	pf.debugPrint(fmt.Sprintf("Received Commit[Seq %d, View %d, Rep %d, Digest %s]\n", args.SeqId, args.ViewId, args.ReplicaId, args.Digest))
+	if !pf.authReplica(args.ReplicaId, args) {
+		reply.Err = "Invalid authenticator"
+		return nil
+	}
 
-	pf.saveCommits(args.SeqId, args.ReplicaId, args.Digest)
+	pf.saveCommits(args)
 	pf.processCommits(args.SeqId)
 	return nil
 }
@@ -130,7 +194,29 @@ func (pf *Pbft) Checkpoint(args *CheckpointArgs, reply *DefaultReply) error {
 	defer pf.mu.Unlock()
 
 	pf.debugPrint(fmt.Sprintf("Received Checkpoint[LastCommitted %d, Digest %s, Rep %d]\n", args.LastCommitted, args.Digest, args.ReplicaId))
-	pf.saveCheckpoints(args.LastCommitted, args.ReplicaId, args.Digest)
+	if !pf.verifyReplica(args.ReplicaId, args) {
+		reply.Err = "Invalid signature"
+		return nil
+	}
+
+	if args.LastCommitted <= pf.lastCheckpointSeqId {
+		pf.checkCheckpointDigest(args.LastCommitted, args.ReplicaId, args.Digest)
+		return nil
+	}
+
+	if args.LastCommitted%pf.checkpointInterval != 0 {
+		reply.Err = "Invalid checkpoint"
+		return nil
+	}
+	if args.LastCommitted > pf.highWatermark() {
+		// only the newest checkpoint of every replica above the log window
+		// is kept, a faulty replica can not make the replica keep more
+		pf.saveFutureCheckpoint(args)
+		return nil
+	}
+
+	pf.saveCheckpoints(args)
+	pf.processCheckpoints(args.LastCommitted)
 	return nil
 }
 
@@ -139,23 +225,28 @@ func (pf *Pbft) ViewChange(args *ViewChangeArgs, reply *DefaultReply) error {
 	defer pf.mu.Unlock()
 
 	pf.debugPrint(fmt.Sprintf("Received ViewChange[ViewId %d, Rep %d, LastCheckpoint %d]\n", args.ViewId, args.ReplicaId, args.LastCheckpointSeqId))
-	// check view change message valid
-	if args.ViewId != pf.viewId+1 {
-		reply.Err = "Invalid viewId"
+	if !pf.verifyReplica(args.ReplicaId, args) {
+		reply.Err = "Invalid signature"
 		return nil
 	}
 
-	if args.LastCheckpointSeqId != pf.lastCheckpointSeqId {
-		reply.Err = "Invalid checkpoint sequenceId"
+	// check view change message valid
+	if args.ViewId <= pf.viewId {
+		if args.ViewId == pf.viewId && !pf.viewChanging && pf.newView != nil && pf.newView.ViewId == pf.viewId {
+			// the sender missed the new-view message of the current view
+			go pf.servers[args.ReplicaId].Call("Pbft.NewView", pf.newView, &DefaultReply{})
+		}
+		reply.Err = "Invalid viewId"
 		return nil
 	}
 
-	if args.LastCheckpointDigest != pf.lastCheckpointDigest {
-		reply.Err = "Invalid checkpoint digest"
+	// the sender may be at another stable checkpoint, its proof is
+	// checked with the certificates
+	if !pf.saveViewChange(args) {
+		reply.Err = "Invalid view-change certificate"
 		return nil
 	}
-
-	pf.saveViewChange(args.LastCheckpointSeqId, args.ReplicaId, args.PreparedRequestSet)
+	pf.joinViewChange()
 	pf.provessViewChange(args.ViewId)
 	return nil
 }
@@ -165,27 +256,86 @@ func (pf *Pbft) NewView(args *NewViewArgs, reply *DefaultReply) error {
 	defer pf.mu.Unlock()
 
 	pf.debugPrint(fmt.Sprintf("Received NewView[ViewId %d]\n", args.ViewId))
-	if args.ViewId != pf.viewId+1 {
-		reply.Err = "Invalid viewId"
+	// only the view the replica is moving to is installed, a faulty
+	// replica can not move it to a view of its choice
+	if !pf.viewChanging || args.ViewId != pf.nextViewId {
+		reply.Err = "Not waiting for view"
+		return nil
+	}
+
+	if !pf.verifyReplica(args.ViewId%pf.n, args) {
+		reply.Err = "Invalid signature"
+	} else if !pf.verifyViewChanges(args.ViewId, args.ViewChanges) {
+		reply.Err = "Invalid view-change messages"
+	} else if !pf.verifyNewPreprepares(args) {
+		reply.Err = "Invalid new preprepares"
+	}
+	if reply.Err != "" {
+		// the primary of the view is faulty or the message was forged, the
+		// view-change timer moves the replica on to the next view
+		pf.debugPrint(fmt.Sprintf("NewView[ViewId %d] is invalid: %s\n", args.ViewId, reply.Err))
 		return nil
 	}
 
-	// todo: check correctness of newPreprepares
-	// same as primary generating the newprepreares
+	pf.installNewView(args)
+	return nil
+}
 
-	// enter new view
-	pf.viewId = args.ViewId
-	pf.viewChanges = make(map[int]map[int]PreparedRequest)
-	for seqId, preprepareArgs := range args.NewPreprepares {
-		pf.logs[seqId] = nil
-		delete(pf.prepares, seqId)
-		delete(pf.commits, seqId)
+func (pf *Pbft) FetchState(args *FetchStateArgs, reply *FetchStateReply) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
 
-		reply := &DefaultReply{}
-		args := &preprepareArgs
-		go pf.Preprepare(args, reply)
+	pf.debugPrint(fmt.Sprintf("Received FetchState[SeqId %d] from Rep[%d]\n", args.SeqId, args.ReplicaId))
+	snapshot, ok := pf.snapshots[pf.lastCheckpointSeqId]
+	if pf.lastCheckpointSeqId < args.SeqId || !ok {
+		reply.Err = "Checkpoint not available"
+		return nil
 	}
 
+	reply.SeqId = pf.lastCheckpointSeqId
+	reply.Snapshot = snapshot
+	reply.Proof = pf.lastCheckpointProof
+	return nil
+}
+
+func (pf *Pbft) FetchLog(args *FetchLogArgs, reply *FetchLogReply) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	pf.debugPrint(fmt.Sprintf("Received FetchLog[SeqId %d] from Rep[%d]\n", args.SeqId, args.ReplicaId))
+	for seqId := args.SeqId + 1; seqId <= pf.lastExecuted; seqId++ {
+		logEntry, ok := pf.logs[seqId]
+		if !ok {
+			continue
+		}
+		reply.Entries = append(reply.Entries, *logEntry)
+	}
+	return nil
+}
+
+func (pf *Pbft) QueryStable(args *QueryStableArgs, reply *QueryStableReply) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	pf.debugPrint(fmt.Sprintf("Received QueryStable from Rep[%d]\n", args.ReplicaId))
+	reply.ViewId = pf.viewId
+	reply.SeqId = pf.lastCheckpointSeqId
+	reply.Digest = pf.lastCheckpointDigest
+	reply.Proof = pf.lastCheckpointProof
+	return nil
+}
+
+func (pf *Pbft) NewKey(args *NewKeyArgs, reply *DefaultReply) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	pf.debugPrint(fmt.Sprintf("Received NewKey[Epoch %d] from Rep[%d]\n", args.Epoch, args.ReplicaId))
+	if !pf.verifyReplica(args.ReplicaId, args) {
+		reply.Err = "Invalid signature"
+		return nil
+	}
+
+	pf.auth.installKey(args.ReplicaId, args.Epoch, args.Key)
 	return nil
 }
 
@@ -193,7 +343,27 @@ func (c *Client) Reply(args *ReplyArgs, reply *DefaultReply) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.debugPrint(fmt.Sprintf("Received Reply[%d, %s, %d] from ReplicaId[%d]\n", args.Timestamp, args.Result, args.ViewId, args.ReplicaId))
+	if args.ReplicaId < 0 || args.ReplicaId >= len(c.serverKeys) ||
+		!verifyMessage(c.serverKeys[args.ReplicaId], args) {
+		reply.Err = "Invalid signature"
+		return nil
+	}
+
 	c.saveReply(args)
 	c.processReplies(args.Timestamp)
 	return nil
 }
+
+func (c *Client) NewKey(args *NewKeyArgs, reply *DefaultReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.debugPrint(fmt.Sprintf("Received NewKey[Epoch %d] from ReplicaId[%d]\n", args.Epoch, args.ReplicaId))
+	if args.ReplicaId < 0 || args.ReplicaId >= len(c.serverKeys) ||
+		!verifyMessage(c.serverKeys[args.ReplicaId], args) {
+		reply.Err = "Invalid signature"
+		return nil
+	}
+
+	c.auth.installKey(args.ReplicaId, args.Epoch, args.Key)
+	return nil
+}
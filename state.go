@@ -0,0 +1,88 @@
+package pbft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// StateMachine is the replicated service run on top of the consensus.
+// Committed operations are applied in sequence order on every replica, so
+// Apply must be deterministic. Digest must only depend on the state, it is
+// compared between replicas at every checkpoint.
+type StateMachine interface {
+	Apply(operation []byte) []byte
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+	Digest() string
+}
+
+// ReadOnlyStateMachine is implemented by state machines that can execute
+// read-only operations against their current state without ordering.
+// Query returns an error for operations that modify the state.
+type ReadOnlyStateMachine interface {
+	StateMachine
+	Query(operation []byte) ([]byte, error)
+}
+
+// EchoStateMachine echoes every operation back as its result and folds it
+// into a hash chain, so two replicas have the same state only if they
+// applied the same operations in the same order.
+type EchoStateMachine struct {
+	Applied int
+	Chain   []byte
+}
+
+func NewEchoStateMachine() *EchoStateMachine {
+	return &EchoStateMachine{}
+}
+
+func (es *EchoStateMachine) Apply(operation []byte) []byte {
+	h := sha256.New()
+	h.Write(es.Chain)
+	h.Write(operation)
+	es.Chain = h.Sum(nil)
+	es.Applied++
+	return operation
+}
+
+func (es *EchoStateMachine) Snapshot() ([]byte, error) {
+	return json.Marshal(es)
+}
+
+func (es *EchoStateMachine) Restore(snapshot []byte) error {
+	restored := EchoStateMachine{}
+	err := json.Unmarshal(snapshot, &restored)
+	if err != nil {
+		return err
+	}
+	*es = restored
+	return nil
+}
+
+// Digest returns the hex encoded SHA-256 of the snapshot of the state.
+func (es *EchoStateMachine) Digest() string {
+	snapshot, _ := es.Snapshot()
+	return snapshotDigest(snapshot)
+}
+
+func snapshotDigest(snapshot []byte) string {
+	sum := sha256.Sum256(snapshot)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpointState is the state a checkpoint covers: the snapshot of the
+// state machine and the last reply to every client. A replica that
+// installs it drops requests the clients already got a result for, like
+// the replicas it was taken from.
+type checkpointState struct {
+	Snapshot []byte
+	Replies  map[int]checkpointReply
+}
+
+// checkpointReply is the part of the last reply to a client every replica
+// agrees on.
+type checkpointReply struct {
+	Timestamp int64
+	Result    []byte
+}
@@ -0,0 +1,151 @@
+package pbft
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+type RecordType int
+
+const (
+	PreprepareRecord = iota
+	PrepareRecord
+	CommitRecord
+	CheckpointRecord
+	MetadataRecord
+)
+
+// StableCheckpoint is a checkpoint that became stable with the 2f+1
+// checkpoint messages proving it.
+type StableCheckpoint struct {
+	SeqId  int
+	Digest string
+	Proof  []CheckpointArgs
+}
+
+// Metadata is the view the replica is in or moving to and the last
+// sequence id it assigned.
+type Metadata struct {
+	ViewId       int
+	NextViewId   int
+	ViewChanging bool
+	SeqId        int
+}
+
+// Record is a single entry of the replica log, only the field matching
+// Type is set. Implementations must return the messages exactly as they
+// were saved, the JSON encoding used for signing keeps them intact.
+type Record struct {
+	Type       RecordType
+	Preprepare *PrePrepareAgrs   `json:",omitempty"`
+	Prepare    *PrepareArgs      `json:",omitempty"`
+	Commit     *CommitArgs       `json:",omitempty"`
+	Checkpoint *StableCheckpoint `json:",omitempty"`
+	Metadata   *Metadata         `json:",omitempty"`
+}
+
+// Storage keeps the log of a replica and the snapshot of its last stable
+// checkpoint across restarts. A replica appends a record before it acts
+// on it and stops if Append fails, so Append must not return before the
+// record is as durable as the implementation promises.
+type Storage interface {
+	// Append adds a record to the end of the log.
+	Append(record *Record) error
+	// Replay calls apply for every record in the order they were appended.
+	Replay(apply func(record *Record)) error
+	// Compact atomically replaces the whole log by records. It is called
+	// once a checkpoint became stable, records below it are not needed
+	// anymore.
+	Compact(records []*Record) error
+	// SaveSnapshot stores the snapshot of a stable checkpoint, the state
+	// machine with the last reply to every client. Older snapshots may be
+	// kept or dropped.
+	SaveSnapshot(seqId int, snapshot []byte) error
+	// LoadSnapshot returns the last saved snapshot, or nil if there is
+	// none.
+	LoadSnapshot() (int, []byte, error)
+	Close() error
+}
+
+// MemoryStorage keeps everything in memory, it survives restarting a
+// replica in the same process only. Records are stored encoded, so they
+// come back as copies like from a disk.
+type MemoryStorage struct {
+	mu       *sync.Mutex
+	records  [][]byte
+	seqId    int
+	snapshot []byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	ms := &MemoryStorage{}
+	ms.mu = &sync.Mutex{}
+	return ms
+}
+
+func (ms *MemoryStorage) Append(record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.records = append(ms.records, data)
+	return nil
+}
+
+func (ms *MemoryStorage) Replay(apply func(record *Record)) error {
+	ms.mu.Lock()
+	records := ms.records
+	ms.mu.Unlock()
+
+	for _, data := range records {
+		record := &Record{}
+		err := json.Unmarshal(data, record)
+		if err != nil {
+			return err
+		}
+		apply(record)
+	}
+	return nil
+}
+
+func (ms *MemoryStorage) Compact(records []*Record) error {
+	encoded := make([][]byte, 0, len(records))
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, data)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.records = encoded
+	return nil
+}
+
+func (ms *MemoryStorage) SaveSnapshot(seqId int, snapshot []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.seqId = seqId
+	ms.snapshot = append([]byte(nil), snapshot...)
+	return nil
+}
+
+func (ms *MemoryStorage) LoadSnapshot() (int, []byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.snapshot == nil {
+		return 0, nil, nil
+	}
+	return ms.seqId, append([]byte(nil), ms.snapshot...), nil
+}
+
+// Close does nothing, the records stay available to a replica started on
+// the same storage.
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,248 @@
+package pbft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// checkpointReplies returns the last reply to every client in the form
+// covered by checkpoints.
+func (pf *Pbft) checkpointReplies() map[int]checkpointReply {
+	replies := make(map[int]checkpointReply)
+	for clientId, lastReply := range pf.lastReplies {
+		replies[clientId] = checkpointReply{lastReply.Timestamp, lastReply.Result}
+	}
+	return replies
+}
+
+// snapshotState encodes the state covered by a checkpoint.
+func (pf *Pbft) snapshotState() ([]byte, error) {
+	snapshot, err := pf.sm.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	state := &checkpointState{}
+	state.Snapshot = snapshot
+	state.Replies = pf.checkpointReplies()
+	return json.Marshal(state)
+}
+
+// restoreState replaces the state machine and the last replies by an
+// encoded checkpoint state. The replies are resent in the current view.
+func (pf *Pbft) restoreState(data []byte) error {
+	state := &checkpointState{}
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	err = pf.sm.Restore(state.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	pf.lastReplies = make(map[int]*ReplyArgs)
+	for clientId, reply := range state.Replies {
+		replyArgs := &ReplyArgs{}
+		replyArgs.ViewId = pf.viewId
+		replyArgs.ReplicaId = pf.me
+		replyArgs.Timestamp = reply.Timestamp
+		replyArgs.Result = reply.Result
+		pf.lastReplies[clientId] = replyArgs
+	}
+	return nil
+}
+
+// stateDigest returns the digest of the state covered by a checkpoint,
+// the digest of the state machine followed by the last replies.
+func (pf *Pbft) stateDigest() string {
+	replies, _ := json.Marshal(pf.checkpointReplies())
+	h := sha256.New()
+	h.Write([]byte(pf.sm.Digest()))
+	h.Write(replies)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyCheckpointProof checks that proof holds 2f+1 correctly signed
+// checkpoint messages from distinct replicas for the same seqId and
+// digest.
+func (pf *Pbft) verifyCheckpointProof(seqId int, digest string, proof []CheckpointArgs) bool {
+	replicas := make(map[int]bool)
+	for i := range proof {
+		checkpoint := &proof[i]
+		if checkpoint.LastCommitted != seqId || checkpoint.Digest != digest {
+			continue
+		}
+		if replicas[checkpoint.ReplicaId] || !pf.verifyReplica(checkpoint.ReplicaId, checkpoint) {
+			continue
+		}
+		replicas[checkpoint.ReplicaId] = true
+	}
+	return len(replicas) > 2*pf.f
+}
+
+// fetchState starts a state transfer unless one is already running. The
+// snapshot of the stable checkpoint seqId is only fetched if the replica
+// has not executed up to it, the committed entries after the last
+// executed one are fetched in any case.
+func (pf *Pbft) fetchState(seqId int) {
+	if pf.fetching {
+		return
+	}
+	pf.fetching = true
+	pf.debugPrint(fmt.Sprintf("Fetching state: checkpoint %d, executed %d\n", seqId, pf.lastExecuted))
+	go pf.runStateTransfer(seqId)
+}
+
+func (pf *Pbft) runStateTransfer(seqId int) {
+	args := &FetchStateArgs{}
+	args.ReplicaId = pf.me
+	args.SeqId = seqId
+	pf.mu.Lock()
+	needSnapshot := pf.lastExecuted < seqId
+	pf.mu.Unlock()
+	installed := false
+	for id, peer := range pf.servers {
+		if !needSnapshot || id == pf.me {
+			continue
+		}
+
+		reply := &FetchStateReply{}
+		err := peer.Call("Pbft.FetchState", args, reply)
+		if err != nil || reply.Err != "" {
+			continue
+		}
+
+		pf.mu.Lock()
+		installed = pf.installState(reply)
+		pf.mu.Unlock()
+		if installed {
+			break
+		}
+	}
+
+	pf.mu.Lock()
+	fromSeqId := pf.lastExecuted
+	pf.mu.Unlock()
+	entries := pf.collectLog(fromSeqId)
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.installLog(entries)
+	pf.fetching = false
+	if installed && pf.lastExecuted < pf.lastCheckpointSeqId {
+		// the peers moved on while fetching, otherwise the gap timer
+		// retries
+		pf.fetchState(pf.lastCheckpointSeqId)
+	}
+}
+
+// installState verifies a snapshot against its checkpoint certificate and
+// replaces the local state with it.
+func (pf *Pbft) installState(reply *FetchStateReply) bool {
+	if len(reply.Proof) == 0 {
+		return false
+	}
+	digest := reply.Proof[0].Digest
+	if !pf.verifyCheckpointProof(reply.SeqId, digest, reply.Proof) {
+		pf.debugPrint(fmt.Sprintf("Fetched state is invalid: checkpoint %d\n", reply.SeqId))
+		return false
+	}
+
+	if reply.SeqId <= pf.lastExecuted {
+		return true
+	}
+
+	// keep the current state in case the snapshot does not restore to
+	// the certified digest
+	current, err := pf.snapshotState()
+	if err != nil {
+		return false
+	}
+	err = pf.restoreState(reply.Snapshot)
+	if err != nil || pf.stateDigest() != digest {
+		pf.debugPrint(fmt.Sprintf("Fetched state does not restore to checkpoint %d\n", reply.SeqId))
+		pf.restoreState(current)
+		return false
+	}
+	pf.tentative = nil
+	// the snapshot may have executed requests the replica is still timing,
+	// the clients retransmit the others
+	for key, timer := range pf.requestTimer {
+		timer.Cancel()
+		delete(pf.requestTimer, key)
+	}
+	pf.lastExecuted = reply.SeqId
+	if pf.maxCommitted < reply.SeqId {
+		pf.maxCommitted = reply.SeqId
+	}
+	pf.snapshots[reply.SeqId] = reply.Snapshot
+	if reply.SeqId > pf.lastCheckpointSeqId {
+		pf.stabilizeCheckpoint(reply.SeqId, digest, reply.Proof)
+	}
+	pf.debugPrint(fmt.Sprintf("Installed state of checkpoint %d\n", reply.SeqId))
+	pf.executeCommitted()
+	return true
+}
+
+// collectLog asks every peer for the entries committed after fromSeqId.
+// An entry is kept only if f+1 distinct peers returned the same batch for
+// it, so at least one of them is correct. A peer votes once per sequence
+// id, the repeated ones of a reply are ignored.
+func (pf *Pbft) collectLog(fromSeqId int) map[int]LogEntry {
+	args := &FetchLogArgs{}
+	args.ReplicaId = pf.me
+	args.SeqId = fromSeqId
+
+	voters := make(map[int]map[string]map[int]bool)
+	entries := make(map[int]LogEntry)
+	for id, peer := range pf.servers {
+		if id == pf.me {
+			continue
+		}
+
+		reply := &FetchLogReply{}
+		err := peer.Call("Pbft.FetchLog", args, reply)
+		if err != nil || reply.Err != "" {
+			continue
+		}
+
+		voted := make(map[int]bool)
+		for _, entry := range reply.Entries {
+			if entry.SeqId <= fromSeqId || voted[entry.SeqId] {
+				continue
+			}
+			voted[entry.SeqId] = true
+
+			digest := batchDigest(entry.Requests)
+			if voters[entry.SeqId] == nil {
+				voters[entry.SeqId] = make(map[string]map[int]bool)
+			}
+			if voters[entry.SeqId][digest] == nil {
+				voters[entry.SeqId][digest] = make(map[int]bool)
+			}
+			voters[entry.SeqId][digest][id] = true
+			if len(voters[entry.SeqId][digest]) > pf.f {
+				entry.Digest = digest
+				entries[entry.SeqId] = entry
+			}
+		}
+	}
+	return entries
+}
+
+func (pf *Pbft) installLog(entries map[int]LogEntry) {
+	for seqId, entry := range entries {
+		if seqId <= pf.lastExecuted || seqId <= pf.lastCheckpointSeqId {
+			continue
+		}
+		logEntry := entry
+		logEntry.Phase = PbftPhasecommitted
+		pf.logs[seqId] = &logEntry
+		if seqId > pf.maxCommitted {
+			pf.maxCommitted = seqId
+		}
+	}
+	pf.executeCommitted()
+}